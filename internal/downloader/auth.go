@@ -0,0 +1,278 @@
+package downloader
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+type AuthType string
+
+const (
+	AuthBasic  AuthType = "basic"
+	AuthBearer AuthType = "bearer"
+	AuthDigest AuthType = "digest" // used after server responds with 401 and challenge
+)
+
+// credentials of download, they are saved with download list,
+// but never sent to clients or written to log
+type Auth struct {
+	Type     AuthType `json:"type"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	Token    string   `json:"token,omitempty"`
+}
+
+// check credentials from user, nil is returned when type is empty
+func ParseAuth(authType, username, password, token string) (*Auth, error) {
+	auth := &Auth{
+		Type:     AuthType(strings.ToLower(strings.TrimSpace(authType))),
+		Username: username,
+		Password: password,
+		Token:    strings.TrimSpace(token),
+	}
+
+	switch auth.Type {
+	case "":
+		return nil, nil
+	case AuthBasic, AuthDigest:
+		if auth.Username == "" {
+			return nil, fmt.Errorf("%s auth requires username", auth.Type)
+		}
+		// colon would be taken as end of username
+		if auth.Type == AuthBasic && strings.Contains(auth.Username, ":") {
+			return nil, fmt.Errorf("username can't contain colon")
+		}
+		auth.Token = ""
+	case AuthBearer:
+		if auth.Token == "" {
+			return nil, fmt.Errorf("bearer auth requires token")
+		}
+		auth.Username = ""
+		auth.Password = ""
+	default:
+		return nil, fmt.Errorf("unsupported auth type: %s", authType)
+	}
+
+	if strings.ContainsAny(auth.Username+auth.Password+auth.Token, "\r\n\x00") {
+		return nil, fmt.Errorf("credentials contain invalid characters")
+	}
+	return auth, nil
+}
+
+// digest challenge from server, shared by all requests of download
+type digestChallenge struct {
+	mu        sync.Mutex
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	qop       string // "auth" or empty when server did not send qop
+	count     int    // nonce count, must grow with every request
+}
+
+// split params of auth header, e.g. realm="a, b", qop=auth
+func parseAuthParams(s string) map[string]string {
+	params := map[string]string{}
+	for s != "" {
+		s = strings.TrimLeft(s, " ,")
+		key, rest, found := strings.Cut(s, "=")
+		if !found {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		rest = strings.TrimLeft(rest, " ")
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			// quoted value can contain commas and escaped chars
+			var b strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				b.WriteByte(rest[i])
+			}
+			value = b.String()
+			s = rest[min(i+1, len(rest)):]
+		} else {
+			value, s, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+		}
+		params[key] = value
+	}
+	return params
+}
+
+// find digest challenge in response of 401, nil if there is none or it is not supported
+func parseDigestChallenge(resp *http.Response) *digestChallenge {
+	for _, header := range resp.Header.Values("WWW-Authenticate") {
+		scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+		if !strings.EqualFold(scheme, "Digest") {
+			continue
+		}
+
+		params := parseAuthParams(rest)
+		challenge := &digestChallenge{
+			realm:     params["realm"],
+			nonce:     params["nonce"],
+			opaque:    params["opaque"],
+			algorithm: params["algorithm"],
+		}
+		if challenge.nonce == "" || newDigestHash(challenge.algorithm) == nil {
+			continue
+		}
+
+		// auth-int would need hash of request body, auth is enough for GET
+		if params["qop"] != "" {
+			for _, qop := range strings.Split(params["qop"], ",") {
+				if strings.TrimSpace(qop) == "auth" {
+					challenge.qop = "auth"
+				}
+			}
+			if challenge.qop == "" {
+				continue
+			}
+		}
+		return challenge
+	}
+	return nil
+}
+
+func newDigestHash(algorithm string) hash.Hash {
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "", "MD5":
+		return md5.New()
+	case "SHA-256":
+		return sha256.New()
+	}
+	return nil
+}
+
+func digestHex(algorithm string, parts ...string) string {
+	h := newDigestHash(algorithm)
+	h.Write([]byte(strings.Join(parts, ":")))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Authorization header for request, see RFC 7616
+func (c *digestChallenge) authorization(auth *Auth, method, uri string) string {
+	c.mu.Lock()
+	c.count++
+	count := fmt.Sprintf("%08x", c.count)
+	c.mu.Unlock()
+
+	cnonceBytes := make([]byte, 16)
+	rand.Read(cnonceBytes)
+	cnonce := hex.EncodeToString(cnonceBytes)
+
+	ha1 := digestHex(c.algorithm, auth.Username, c.realm, auth.Password)
+	if strings.HasSuffix(strings.ToUpper(c.algorithm), "-SESS") {
+		ha1 = digestHex(c.algorithm, ha1, c.nonce, cnonce)
+	}
+	ha2 := digestHex(c.algorithm, method, uri)
+
+	var response string
+	if c.qop == "" {
+		response = digestHex(c.algorithm, ha1, c.nonce, ha2)
+	} else {
+		response = digestHex(c.algorithm, ha1, c.nonce, count, cnonce, c.qop, ha2)
+	}
+
+	quote := func(s string) string {
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+	}
+
+	params := []string{
+		"username=" + quote(auth.Username),
+		"realm=" + quote(c.realm),
+		"nonce=" + quote(c.nonce),
+		"uri=" + quote(uri),
+		"response=" + quote(response),
+	}
+	if c.algorithm != "" {
+		params = append(params, "algorithm="+c.algorithm)
+	}
+	if c.opaque != "" {
+		params = append(params, "opaque="+quote(c.opaque))
+	}
+	if c.qop != "" {
+		params = append(params, "qop="+c.qop, "nc="+count, "cnonce="+quote(cnonce))
+	}
+	return "Digest " + strings.Join(params, ", ")
+}
+
+// type of credentials for dto, empty when download has none
+func (d *DownloadItem) authType() string {
+	if d.auth == nil {
+		return ""
+	}
+	return string(d.auth.Type)
+}
+
+// add credentials to request, digest is added only when challenge is known
+func (d *DownloadItem) setAuth(req *http.Request) {
+	if d.auth == nil {
+		return
+	}
+
+	switch d.auth.Type {
+	case AuthBasic:
+		req.SetBasicAuth(d.auth.Username, d.auth.Password)
+	case AuthBearer:
+		req.Header.Set("Authorization", "Bearer "+d.auth.Token)
+	case AuthDigest:
+		d.Lock()
+		challenge := d.digest
+		d.Unlock()
+		if challenge != nil {
+			req.Header.Set("Authorization", challenge.authorization(d.auth, req.Method, req.URL.RequestURI()))
+		}
+	}
+}
+
+// send request, digest auth answers 401 challenge and sends request once more
+func (d *DownloadItem) do(client *http.Client, req *http.Request) (*http.Response, error) {
+	d.setAuth(req)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	d.rememberFinalUrl(resp)
+	if resp.StatusCode != http.StatusUnauthorized || d.auth == nil || d.auth.Type != AuthDigest {
+		return resp, nil
+	}
+
+	challenge := parseDigestChallenge(resp)
+	if challenge == nil {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	// new challenge replaces old one, e.g. when nonce is stale
+	d.Lock()
+	d.digest = challenge
+	d.Unlock()
+
+	// challenge can come from url after redirect, digest is computed for that url
+	retryReq := req.Clone(req.Context())
+	if resp.Request != nil && resp.Request.URL.String() != req.URL.String() {
+		retryReq.URL = resp.Request.URL
+		retryReq.Host = ""
+	}
+	d.setAuth(retryReq)
+	resp, err = client.Do(retryReq)
+	if err != nil {
+		return nil, err
+	}
+	d.rememberFinalUrl(resp)
+	return resp, nil
+}
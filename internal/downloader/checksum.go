@@ -0,0 +1,125 @@
+package downloader
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// digest of downloaded file does not match expected one
+var ErrChecksumMismatch = errors.New("verification failed, checksum mismatch")
+
+func newHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "md5":
+		return md5.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm: %s", algorithm)
+	}
+}
+
+// parse checksum in form algorithm:hex, e.g. sha256:9f86d0...,
+// returned values are lowercase
+func ParseChecksum(checksum string) (string, string, error) {
+	algorithm, digest, found := strings.Cut(strings.TrimSpace(checksum), ":")
+	if !found {
+		return "", "", fmt.Errorf("checksum must be in form algorithm:hex")
+	}
+	algorithm = strings.ToLower(algorithm)
+	digest = strings.ToLower(digest)
+
+	h, err := newHash(algorithm)
+	if err != nil {
+		return "", "", err
+	}
+
+	decoded, err := hex.DecodeString(digest)
+	if err != nil || len(decoded) != h.Size() {
+		return "", "", fmt.Errorf("checksum is not valid %s hex digest", algorithm)
+	}
+
+	return algorithm, digest, nil
+}
+
+// hash first n bytes of file, used for data downloaded before resume
+// or for whole file when it was not hashed while streaming
+func hashFile(path string, h hash.Hash, n int64) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(h, io.LimitReader(file, n))
+	return err
+}
+
+// hasher for single stream download, it continues from resumeByte,
+// so only the part already on disk is read again
+func (d *DownloadItem) startStreamHash(resumeByte int64) error {
+	d.streamHash = nil
+	if d.ChecksumAlgorithm == "" {
+		return nil
+	}
+
+	h, err := newHash(d.ChecksumAlgorithm)
+	if err != nil {
+		return err
+	}
+	if resumeByte > 0 {
+		if err := hashFile(d.partPath(), h, resumeByte); err != nil {
+			return err
+		}
+	}
+	d.streamHash = h
+	return nil
+}
+
+// compare digest of finished file with expected one
+func (d *DownloadItem) verify() error {
+	if d.ChecksumAlgorithm == "" {
+		return nil
+	}
+
+	// segmented downloads write out of order, so they are hashed at the end
+	h := d.streamHash
+	if h == nil {
+		var err error
+		h, err = newHash(d.ChecksumAlgorithm)
+		if err != nil {
+			return err
+		}
+		d.Lock()
+		size := d.Size
+		d.Unlock()
+		if err := hashFile(d.partPath(), h, size); err != nil {
+			return err
+		}
+	}
+	d.streamHash = nil
+
+	digest := hex.EncodeToString(h.Sum(nil))
+
+	d.Lock()
+	d.Digest = digest
+	d.Unlock()
+
+	if digest != d.Checksum {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+// category of download failure, sent to clients as error code
+type ErrorKind string
+
+const (
+	ErrorHTTPStatus   ErrorKind = "http_status"  // server responded with unexpected status
+	ErrorNetwork      ErrorKind = "network"      // connection failed, timed out or stalled
+	ErrorDisk         ErrorKind = "disk"         // file could not be created or written
+	ErrorCancelled    ErrorKind = "cancelled"    // download ctx ended with error
+	ErrorVerification ErrorKind = "verification" // checksum mismatch
+	ErrorOther        ErrorKind = "other"
+)
+
+// error of failed download with category, so UI and scripts can react differently
+type DownloadError struct {
+	Kind       ErrorKind
+	StatusCode int // http status, 0 for other kinds
+	Err        error
+}
+
+func (e *DownloadError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DownloadError) Unwrap() error {
+	return e.Err
+}
+
+// human readable description of error
+func (e *DownloadError) Message() string {
+	switch e.Kind {
+	case ErrorHTTPStatus:
+		switch {
+		case e.StatusCode == http.StatusNotFound:
+			return "file not found on server"
+		case e.StatusCode == http.StatusUnauthorized:
+			return "server requires authentication"
+		case e.StatusCode == http.StatusForbidden:
+			return "access to file denied by server"
+		case e.StatusCode == http.StatusTooManyRequests:
+			return "too many requests, server is limiting downloads"
+		case e.StatusCode >= 500:
+			return "server error, try again later"
+		case e.StatusCode > 0:
+			return fmt.Sprintf("server responded with %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+		}
+		return "server sent unexpected response"
+	case ErrorNetwork:
+		if errors.Is(e.Err, errStalled) {
+			return "download stalled, server stopped sending data"
+		}
+		return "network error, could not get data from server"
+	case ErrorDisk:
+		if errors.Is(e.Err, syscall.ENOSPC) {
+			return "not enough free space on disk"
+		}
+		return "could not write file to disk"
+	case ErrorCancelled:
+		return "download was cancelled"
+	case ErrorVerification:
+		return "downloaded file does not match expected checksum"
+	}
+	return e.Err.Error()
+}
+
+// wrap error with its category, already wrapped error is returned as is
+func classifyError(err error) *DownloadError {
+	var downloadErr *DownloadError
+	if errors.As(err, &downloadErr) {
+		return downloadErr
+	}
+
+	kind := ErrorOther
+	statusCode := 0
+
+	var statusErr *statusError
+	var netErr net.Error
+	var readErr *bodyReadError
+
+	switch {
+	case errors.As(err, &statusErr):
+		kind = ErrorHTTPStatus
+		statusCode = statusErr.StatusCode
+	case errors.Is(err, ErrChecksumMismatch):
+		kind = ErrorVerification
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		kind = ErrorCancelled
+	case isDiskError(err):
+		kind = ErrorDisk
+	case errors.As(err, &netErr),
+		errors.As(err, &readErr),
+		errors.Is(err, errStalled),
+		errors.Is(err, errRemoteChanged),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.EPIPE):
+		kind = ErrorNetwork
+	}
+
+	return &DownloadError{Kind: kind, StatusCode: statusCode, Err: err}
+}
+
+// file could not be created or written
+func isDiskError(err error) bool {
+	var pathErr *fs.PathError
+	return errors.As(err, &pathErr) || errors.Is(err, syscall.ENOSPC)
+}
+
+// server answered range request with other range than asked, next attempt asks again
+var errBadRange = errors.New("unexpected range")
+
+// error for server response that breaks range request rules
+func rangeError(resp *http.Response, format string, args ...any) *DownloadError {
+	return &DownloadError{
+		Kind:       ErrorHTTPStatus,
+		StatusCode: resp.StatusCode,
+		Err:        fmt.Errorf("%w: %s", errBadRange, fmt.Sprintf(format, args...)),
+	}
+}
@@ -0,0 +1,210 @@
+package downloader
+
+import (
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/matejeliash/medownloader/internal/dto"
+)
+
+// progress is published once per interval, changes in between are coalesced
+const progressInterval = time.Second
+
+// events buffered for single subscriber, subscriber which falls behind is dropped
+const eventBuffer = 256
+
+type EventType string
+
+const (
+	EventAdded        EventType = "added"
+	EventStateChanged EventType = "state" // any change of state, typed event follows when there is one
+	EventProgress     EventType = "progress"
+	EventSummary      EventType = "summary" // totals, sent together with progress
+
+	// typed events derived from change of state
+	EventStarted   EventType = "started" // goroutine picked item from queue, retries are not counted
+	EventPaused    EventType = "paused"
+	EventCompleted EventType = "completed"
+	EventFailed    EventType = "failed"
+	EventDeleted   EventType = "deleted"
+)
+
+// change of download, data is snapshot taken when event happened
+type Event struct {
+	Type     EventType
+	Id       int64
+	From     State                    // previous state, for state and typed events
+	Item     *dto.DownloadItemDto     // added, state and typed events
+	Progress *dto.ProgressDto         // progress events
+	Summary  *dto.DownloadsSummaryDto // summary events
+}
+
+// typed event for change of state, empty if there is none
+func lifecycleEvent(from, to State) EventType {
+	switch to {
+	case StateConnecting:
+		if from == StateQueued {
+			return EventStarted
+		}
+	case StatePaused:
+		return EventPaused
+	case StateCompleted:
+		return EventCompleted
+	case StateFailed:
+		return EventFailed
+	case StateCancelled:
+		return EventDeleted
+	}
+	return ""
+}
+
+type subscriber struct {
+	ch      chan Event
+	types   []EventType // empty means all types
+	drop    bool        // drop events when buffer is full instead of ending subscription
+	dropped int
+}
+
+func (s *subscriber) wants(eventType EventType) bool {
+	return len(s.types) == 0 || slices.Contains(s.types, eventType)
+}
+
+// sends events to all subscribers, publishing never waits for them
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]*subscriber
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subscribers: map[chan Event]*subscriber{}}
+}
+
+// channel subscriber with full buffer is removed and its channel closed,
+// it has missed events, so it must load whole state and subscribe again
+func (h *eventHub) publish(event Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch, sub := range h.subscribers {
+		if !sub.wants(event.Type) {
+			continue
+		}
+		select {
+		case ch <- event:
+		default:
+			if sub.drop {
+				if sub.dropped == 0 {
+					slog.Warn("event subscriber is too slow, events are dropped")
+				}
+				sub.dropped++
+				continue
+			}
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// find if anyone listens to some of types
+func (h *eventHub) hasSubscribers(types ...EventType) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, sub := range h.subscribers {
+		for _, eventType := range types {
+			if sub.wants(eventType) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (h *eventHub) subscribe(sub *subscriber) func() {
+	h.mu.Lock()
+	h.subscribers[sub.ch] = sub
+	h.mu.Unlock()
+
+	return func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subscribers[sub.ch]; ok {
+			delete(h.subscribers, sub.ch)
+			close(sub.ch)
+		}
+	}
+}
+
+// get channel with events of given types, all types if none is given, and function
+// which ends subscription, channel is closed when subscriber does not keep up
+func (d *DownloadManager) Subscribe(types ...EventType) (<-chan Event, func()) {
+	sub := &subscriber{ch: make(chan Event, eventBuffer), types: types}
+	return sub.ch, d.events.subscribe(sub)
+}
+
+// call fn for every event of given types, all types if none is given, returns function
+// which ends subscription, fn runs in its own goroutine and events which come
+// while it is behind by whole buffer are dropped
+func (d *DownloadManager) SubscribeFunc(fn func(Event), types ...EventType) func() {
+	sub := &subscriber{ch: make(chan Event, eventBuffer), types: types, drop: true}
+	go func() {
+		for event := range sub.ch {
+			fn(event)
+		}
+	}()
+	return d.events.subscribe(sub)
+}
+
+// publish snapshot of item after its state changed, followed by typed event
+// must be called with item locked
+func (d *DownloadItem) publishState(from State) {
+	if d.events == nil {
+		return
+	}
+	data := d.data()
+	event := Event{Type: EventStateChanged, Id: d.Id, From: from, Item: &data}
+	d.events.publish(event)
+
+	if eventType := lifecycleEvent(from, d.State); eventType != "" {
+		event.Type = eventType
+		d.events.publish(event)
+	}
+}
+
+// periodically publish progress of downloading items and totals,
+// nothing is done while nobody listens
+func (d *DownloadManager) progressLoop() {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !d.events.hasSubscribers(EventProgress, EventSummary) {
+			continue
+		}
+
+		downloads := d.GetAllDownloads()
+		for _, item := range downloads {
+			if item.State != string(StateDownloading) {
+				continue
+			}
+			d.events.publish(Event{
+				Type: EventProgress,
+				Id:   item.Id,
+				Progress: &dto.ProgressDto{
+					Id:           item.Id,
+					Downloaded:   item.Downloaded,
+					Size:         item.Size,
+					Speed:        item.Speed,
+					AverageSpeed: item.AverageSpeed,
+					Eta:          item.Eta,
+					Elapsed:      item.Elapsed,
+				},
+			})
+		}
+
+		summary := d.Summary(downloads)
+		d.events.publish(Event{Type: EventSummary, Summary: &summary})
+	}
+}
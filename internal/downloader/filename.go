@@ -0,0 +1,208 @@
+package downloader
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// max length of file name on common filesystems in bytes
+const maxFilenameLen = 255
+
+// names reserved on windows, with any extension
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// extensions for common types, mime package can return less usual ones first
+var preferredExtensions = map[string]string{
+	"text/html":       ".html",
+	"text/plain":      ".txt",
+	"image/jpeg":      ".jpg",
+	"audio/mpeg":      ".mp3",
+	"video/mp4":       ".mp4",
+	"application/zip": ".zip",
+	"application/pdf": ".pdf",
+}
+
+// make name safe for any filesystem, directories are removed,
+// returns empty string if nothing usable is left
+func SanitizeFilename(name string) string {
+	// keep only last part of path, both separators are removed
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+
+	// windows does not allow trailing dots and spaces
+	name = strings.TrimRight(strings.TrimSpace(name), ". ")
+	if name == "" || name == "." || name == ".." {
+		return ""
+	}
+
+	base := strings.ToUpper(strings.SplitN(name, ".", 2)[0])
+	if reservedNames[base] {
+		name = "_" + name
+	}
+
+	// shorten name, but keep extension
+	if len(name) > maxFilenameLen {
+		ext := filepath.Ext(name)
+		if len(ext) > 32 {
+			ext = ""
+		}
+		name = strings.ToValidUTF8(name[:maxFilenameLen-len(ext)], "") + ext
+	}
+	return name
+}
+
+// get filename from url path, e.g. http://..../a%20b.txt?x=1 -> a b.txt
+func FilenameFromUrl(rawUrl string) string {
+	urlObj, err := url.Parse(rawUrl)
+	if err != nil {
+		return ""
+	}
+
+	// Path is already percent-decoded and has no query
+	name := path.Base(urlObj.Path)
+	if name == "/" || name == "." {
+		return ""
+	}
+	return SanitizeFilename(name)
+}
+
+// extension for Content-Type, empty for unknown or generic binary data
+func extensionForType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "application/octet-stream" {
+		return ""
+	}
+	if ext, ok := preferredExtensions[mediaType]; ok {
+		return ext
+	}
+	if exts, err := mime.ExtensionsByType(mediaType); err == nil && len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+// name suggested by response: Content-Disposition first, then final url after redirects,
+// extension is guessed from Content-Type when name has none
+func filenameFromResponse(resp *http.Response) string {
+	name := ""
+
+	// ParseMediaType also decodes RFC 5987 filename*=UTF-8''...
+	if disposition := resp.Header.Get("Content-Disposition"); disposition != "" {
+		if _, params, err := mime.ParseMediaType(disposition); err == nil {
+			name = SanitizeFilename(params["filename"])
+		}
+	}
+
+	if name == "" && resp.Request != nil {
+		name = FilenameFromUrl(resp.Request.URL.String())
+	}
+
+	if name != "" && filepath.Ext(name) == "" {
+		name += extensionForType(resp.Header.Get("Content-Type"))
+	}
+	return name
+}
+
+// rename download by first response if user did not choose name,
+// must be called before any data is written
+func (d *DownloadItem) resolveFilename(resp *http.Response) {
+	d.Lock()
+	auto := d.AutoFilename
+	d.AutoFilename = false
+	d.Unlock()
+	if !auto || d.rename == nil {
+		return
+	}
+
+	name := filenameFromResponse(resp)
+	if name == "" || name == d.Filename {
+		return
+	}
+
+	// old part file has no data yet
+	d.removeResumeState()
+	os.Remove(d.partPath())
+
+	d.rename(d, name)
+}
+
+// find if file, its part file or other download uses path
+// must be called with manager locked
+func (d *DownloadManager) pathTaken(path string, self *DownloadItem) bool {
+	if _, err := os.Stat(path); err == nil {
+		return true
+	}
+	if _, err := os.Stat(path + d.config.PartSuffix); err == nil {
+		return true
+	}
+
+	for _, item := range d.Downloads {
+		if item == self {
+			continue
+		}
+		item.Lock()
+		itemPath := item.Filepath
+		item.Unlock()
+		if itemPath == path {
+			return true
+		}
+	}
+	return false
+}
+
+// free name and path in dir, time prefix and then also number is added if name is taken
+// must be called with manager locked
+func (d *DownloadManager) freePath(dir, name string, self *DownloadItem) (string, string) {
+	prefix := time.Now().Format("2006-01-02-15-04-05")
+	candidate := name
+	for i := 1; ; i++ {
+		path := filepath.Join(dir, candidate)
+		if !d.pathTaken(path, self) {
+			return candidate, path
+		}
+		if i == 1 {
+			candidate = prefix + "-" + name
+		} else {
+			candidate = fmt.Sprintf("%s-%d-%s", prefix, i, name)
+		}
+	}
+}
+
+// move item to new name in the same dir, name is changed if it is taken
+func (d *DownloadManager) renameItem(item *DownloadItem, name string) {
+	d.Lock()
+	defer d.Unlock()
+
+	item.Lock()
+	dir := filepath.Dir(item.Filepath)
+	item.Unlock()
+
+	filename, path := d.freePath(dir, name, item)
+
+	item.Lock()
+	item.Filename = filename
+	item.Filepath = path
+	item.Unlock()
+}
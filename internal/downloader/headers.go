@@ -0,0 +1,104 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// headers set by downloader itself, custom value would break ranges or connection handling
+var reservedHeaders = map[string]bool{
+	"Range":             true,
+	"If-Range":          true,
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+	"Connection":        true,
+	"Host":              true,
+}
+
+// chars allowed in header name besides letters and digits, see RFC 9110 token
+const headerNameChars = "!#$%&'*+-.^_`|~"
+
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		isAlnum := (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+		if !isAlnum && !strings.ContainsRune(headerNameChars, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// check name and value of single header, returned name is canonical
+func checkHeader(name, value string) (string, error) {
+	name = strings.TrimSpace(name)
+	if !validHeaderName(name) {
+		return "", fmt.Errorf("invalid header name: %q", name)
+	}
+	name = http.CanonicalHeaderKey(name)
+	if reservedHeaders[name] {
+		return "", fmt.Errorf("header %s can't be set", name)
+	}
+	if strings.ContainsAny(value, "\r\n\x00") {
+		return "", fmt.Errorf("invalid value of header %s", name)
+	}
+	return name, nil
+}
+
+// validate custom headers of download, cookie string is added as Cookie header
+func ParseHeaders(headers map[string]string, cookie string) (http.Header, error) {
+	parsed := http.Header{}
+	for name, value := range headers {
+		name, err := checkHeader(name, value)
+		if err != nil {
+			return nil, err
+		}
+		parsed.Set(name, strings.TrimSpace(value))
+	}
+
+	if cookie = strings.TrimSpace(cookie); cookie != "" {
+		if _, err := checkHeader("Cookie", cookie); err != nil {
+			return nil, err
+		}
+		parsed.Set("Cookie", cookie)
+	}
+	return parsed, nil
+}
+
+// parse header in form "Name: value"
+func ParseHeaderLine(line string) (string, string, error) {
+	name, value, found := strings.Cut(line, ":")
+	if !found {
+		return "", "", fmt.Errorf("header must be in form Name: value, got %q", line)
+	}
+	value = strings.TrimSpace(value)
+	name, err := checkHeader(name, value)
+	if err != nil {
+		return "", "", err
+	}
+	return name, value, nil
+}
+
+// create request for download url with server-wide and custom headers,
+// used for every attempt, probe and segment
+func (d *DownloadItem) newRequest(ctx context.Context, method string) (*http.Request, error) {
+	// shared transport finds download by ctx, e.g. to pick its proxy
+	req, err := http.NewRequestWithContext(withItem(ctx, d), method, d.Url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// custom headers replace server-wide ones with the same name
+	for name, values := range d.defaultHeaders {
+		req.Header[name] = slices.Clone(values)
+	}
+	for name, values := range d.Headers {
+		req.Header[name] = slices.Clone(values)
+	}
+	return req, nil
+}
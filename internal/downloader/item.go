@@ -3,11 +3,14 @@ package downloader
 import (
 	"context"
 	"errors"
-	"fmt"
+	"hash"
 	"io"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/matejeliash/medownloader/internal/dto"
 )
@@ -18,14 +21,72 @@ type DownloadItem struct {
 	Url        string
 	Filename   string
 	Filepath   string
-	Active     bool
-	Completed  bool
+	State      State // changed only with setState
 	Downloaded int64
 	Size       int64
+	Segments   int    // max number of parallel connections
+	PartSuffix string // appended to Filepath while downloading
+	Priority   int    // higher starts first, changed with both manager and item locked
+
+	AutoFilename bool                                  // name not set by user, can be changed by first response
+	rename       func(item *DownloadItem, name string) // gives item free path with name in the same dir
+	stateMu      sync.Mutex                            // serializes writes of resume state file
+
+	segments []*segment // byte ranges when download is split, nil for single stream
+	running  bool       // download goroutine is alive, guarded by manager lock
 
 	Ctx    context.Context    // ctx for signaling  goroutine
 	Cancel context.CancelFunc // run on cancel
 
+	onActive func() // called when data starts flowing, used for saving state
+	events   *eventHub
+
+	limiter       *rateLimiter // per-download bandwidth limit
+	globalLimiter *rateLimiter // limit shared by all downloads
+
+	Headers        http.Header // custom headers including Cookie, sent with every request
+	defaultHeaders http.Header // server-wide headers, custom ones replace them
+
+	Proxy     string // proxy url, direct or empty for server setting
+	ProxyUsed string // proxy of last request without password, direct when none
+
+	TLS      *TLSConfig   // overrides server tls settings, nil uses them
+	client   *http.Client // shared by all downloads
+	FinalUrl string       // url after redirects without password, empty before first response
+
+	auth   *Auth            // nil when server needs no credentials, never put into dto
+	digest *digestChallenge // last digest challenge, nil until server sends 401
+
+	Schedule *Schedule // when download can run, nil means any time
+
+	retry     RetryPolicy
+	timeouts  Timeouts
+	Attempt   int       // number of current attempt, starting with 1
+	Retries   int       // retries since server start
+	NextRetry time.Time // zero when not waiting for retry
+
+	// expected digest in lowercase hex, empty when not verified
+	ChecksumAlgorithm  string
+	Checksum           string
+	Digest             string    // computed after download finished
+	VerificationFailed bool      // file downloaded, but digest does not match
+	streamHash         hash.Hash // hash of data written so far, nil for segmented download
+
+	// speed and time tracking
+	meter       *speedMeter
+	globalMeter *speedMeter   // speed of all downloads
+	stats       *stats        // counters of all downloads
+	urlHost     string        // cached host of url for stats
+	Transferred int64         // bytes received over network, resumed data is not counted
+	StartedAt   time.Time     // first start, zero when never started
+	FinishedAt  time.Time     // zero when not completed
+	ActiveTime  time.Duration // time spent downloading before activeSince
+	activeSince time.Time     // start of current active period, zero when not active
+
+	// validators of remote file, resume is allowed only while they match
+	ETag         string
+	LastModified string
+
 	Err error
 }
 
@@ -33,11 +94,22 @@ type DownloadItem struct {
 func (d *DownloadItem) getData() dto.DownloadItemDto {
 	d.Lock()
 	defer d.Unlock()
+	return d.data()
+}
 
-	// convert error to string
+// must be called with item locked
+func (d *DownloadItem) data() dto.DownloadItemDto {
+	// convert error to string, code and human message
 	errStr := ""
+	errCode := ""
+	errMsg := ""
+	httpStatus := 0
 	if d.Err != nil {
-		errStr = d.Err.Error()
+		downloadErr := classifyError(d.Err)
+		errStr = downloadErr.Error()
+		errCode = string(downloadErr.Kind)
+		errMsg = downloadErr.Message()
+		httpStatus = downloadErr.StatusCode
 	}
 
 	dto := dto.DownloadItemDto{
@@ -45,12 +117,46 @@ func (d *DownloadItem) getData() dto.DownloadItemDto {
 		Url:        d.Url,
 		Filename:   d.Filename,
 		Filepath:   d.Filepath,
-		Active:     d.Active,
-		Completed:  d.Completed,
+		State:      string(d.State),
+		Active:     d.State == StateDownloading,
+		Queued:     d.State == StateQueued,
+		Scheduled:  d.State == StateScheduled,
+		Completed:  d.State == StateCompleted,
 		Downloaded: d.Downloaded,
 		Size:       d.Size,
-		Err:        errStr,
+		Segments:   max(len(d.segments), 1),
+		Priority:   d.Priority,
+		RateLimit:  d.limiter.getRate(),
+		Attempt:    d.Attempt,
+		Retries:    d.Retries,
+		AuthType:   d.authType(),
+		Proxy:      d.redactedProxy(),
+		ProxyUsed:  d.ProxyUsed,
+		FinalUrl:   d.FinalUrl,
+
+		InsecureTLS: d.TLS != nil && d.TLS.InsecureSkipVerify,
+		Err:         errStr,
+		ErrCode:     errCode,
+		ErrMsg:      errMsg,
+		HttpStatus:  httpStatus,
+
+		VerificationFailed: d.VerificationFailed,
+	}
+	if d.State != StateCompleted {
+		dto.PartFilepath = d.partPath()
+	}
+	if d.ChecksumAlgorithm != "" {
+		dto.Checksum = d.ChecksumAlgorithm + ":" + d.Checksum
+	}
+	if d.Digest != "" {
+		dto.Digest = d.ChecksumAlgorithm + ":" + d.Digest
+	}
+	if !d.NextRetry.IsZero() {
+		nextRetry := d.NextRetry
+		dto.NextRetry = &nextRetry
 	}
+	d.fillSchedule(&dto)
+	d.fillSpeed(&dto)
 	return dto
 
 }
@@ -63,69 +169,323 @@ func (d *DownloadItem) changeCtx(ctx context.Context, cancel context.CancelFunc)
 	d.Cancel = cancel
 }
 
-func (d *DownloadItem) setDone() {
+func (d *DownloadItem) setSegments(segments []*segment) {
 	d.Lock()
-	d.Completed = true
-	d.Active = false
+	d.segments = segments
 	d.Unlock()
 }
 
-func (d *DownloadItem) setStopped() {
+// host of url without port, empty when url is invalid
+func UrlHost(rawUrl string) string {
+	urlObj, err := url.Parse(rawUrl)
+	if err != nil {
+		return ""
+	}
+	return urlObj.Hostname()
+}
+
+// logger with id and host of download, so its lines can be found
+func (d *DownloadItem) logger() *slog.Logger {
+	return slog.With("download_id", d.Id, "host", UrlHost(d.Url))
+}
+
+func (d *DownloadItem) activated() {
+	if d.onActive != nil {
+		d.onActive()
+	}
+}
+
+// data starts flowing, fails when manager already stopped download
+// must be called with item locked
+func (d *DownloadItem) setActive() error {
+	return d.setState(StateDownloading, nil)
+}
+
+func (d *DownloadItem) setDone() {
 	d.Lock()
-	d.Active = false
+	if err := d.setState(StateCompleted, nil); err != nil {
+		d.logger().Warn("could not mark download as completed", "err", err)
+	}
 	d.Unlock()
 }
 
-// set error and also match booleans to error
+// set error, ignored when download was stopped or deleted meanwhile
 func (d *DownloadItem) setError(err error) {
 	d.Lock()
-	d.Completed = false
-	d.Active = false
-	d.Err = err
+	d.setState(StateFailed, func() {
+		d.Err = classifyError(err)
+	})
 	d.Unlock()
 
 }
 
+// data is downloaded, but it is not file we wanted
+func (d *DownloadItem) setVerificationFailed(err error) {
+	d.Lock()
+	d.setState(StateFailed, func() {
+		d.VerificationFailed = true
+		d.Err = classifyError(err)
+	})
+	d.Unlock()
+}
+
+// keep error of failed attempt visible while waiting for next one
+func (d *DownloadItem) setRetrying(err error, next time.Time) error {
+	d.Lock()
+	defer d.Unlock()
+	return d.setState(StateRetrying, func() {
+		d.Err = classifyError(err)
+		d.NextRetry = next
+		d.Retries++
+		if d.stats != nil {
+			d.stats.addRetry()
+		}
+	})
+}
+
+// move to state from goroutine, false means manager stopped download meanwhile
+func (d *DownloadItem) enterState(state State) bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.State == state || d.setState(state, nil) == nil
+}
+
+// download with retries, every attempt continues from data already on disk,
+// stop by manager changes state and cancels ctx, so goroutine just returns then
 func (d *DownloadItem) download() {
 
+	httpCient := d.client
+
+	d.Lock()
+	d.Attempt = 0
+	d.Unlock()
+
+	// deleted while running, data is removed once nothing writes it anymore
+	defer func() {
+		d.Lock()
+		deleted := d.State == StateCancelled
+		d.Unlock()
+		if deleted {
+			d.removePartFile()
+		}
+	}()
+
+	for {
+		// first attempt is already connecting, manager set it when starting goroutine
+		if !d.enterState(StateConnecting) {
+			return
+		}
+
+		d.Lock()
+		d.Attempt++
+		attempt := d.Attempt
+		downloadedBefore := d.Downloaded
+		d.Unlock()
+
+		err := d.attempt(httpCient)
+		if err == nil {
+			if !d.enterState(StateVerifying) {
+				return
+			}
+			// corrupted file stays as part file
+			if err := d.verify(); err != nil {
+				d.setVerificationFailed(err)
+				d.removeResumeState()
+				return
+			}
+			if err := d.finish(); err != nil {
+				d.setError(err)
+				return
+			}
+			d.setDone()
+			d.removeResumeState()
+			return
+		}
+
+		// ctx used to stop download
+		if d.Ctx.Err() != nil {
+			if errors.Is(d.Ctx.Err(), context.Canceled) {
+				// normal stop, manager already set new state
+				d.keepResumeState()
+				return
+			}
+			d.setError(d.Ctx.Err())
+			d.removeResumeState()
+			return
+		}
+
+		// attempt that made progress is not counted against the limit,
+		// stalled one could trickle few bytes forever, so it always counts
+		d.Lock()
+		if d.Downloaded > downloadedBefore && !errors.Is(err, errStalled) {
+			d.Attempt = 1
+			attempt = 1
+		}
+		d.Unlock()
+
+		if !isRetryable(err) || attempt >= d.retry.MaxAttempts {
+			d.setError(err)
+			d.removeResumeState()
+			return
+		}
+
+		delay := d.retry.backoff(attempt, err)
+		if d.setRetrying(err, time.Now().Add(delay)) != nil {
+			return
+		}
+		d.keepResumeState()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-d.Ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// single try to download rest of the file, watched for stalling
+func (d *DownloadItem) attempt(httpCient *http.Client) error {
+	ctx, cancel := context.WithCancelCause(d.Ctx)
+	defer cancel(nil)
+
+	go d.watchStall(ctx, cancel)
+
+	err := d.transfer(ctx, httpCient)
+	if errors.Is(context.Cause(ctx), errStalled) {
+		return errStalled
+	}
+	return err
+}
+
+func (d *DownloadItem) transfer(ctx context.Context, httpCient *http.Client) error {
+	d.streamHash = nil
+
+	// continue split download where it stopped
+	if d.canResumeSegments() {
+		return d.downloadSegments(ctx, httpCient)
+	}
+	d.Lock()
+	wasSplit := len(d.segments) > 0
+	d.Unlock()
+	d.setSegments(nil)
+
 	//used for resuming
 	var resumeByte int64 = 0
 
-	if info, err := os.Stat(d.Filepath); err == nil {
+	if info, err := os.Stat(d.partPath()); err == nil {
 		resumeByte = info.Size()
 	}
 
-	req, err := http.NewRequestWithContext(d.Ctx, http.MethodGet, d.Url, nil)
-	if err != nil {
-		d.setError(err)
-		return
+	// part file of split download is allocated to full size and has holes,
+	// without matching segment map it can't be continued,
+	// single stream file has no holes and is just appended
+	d.Lock()
+	preallocated := d.Size > 0 && resumeByte == d.Size && d.Downloaded < d.Size
+	d.Unlock()
+	if resumeByte > 0 && (wasSplit || preallocated) {
+		if err := d.resetProgress(); err != nil {
+			return err
+		}
+		resumeByte = 0
 	}
 
-	if resumeByte > 0 {
-		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", resumeByte))
+	// split only fresh downloads, partial single stream files are just appended
+	if d.Segments > 1 && resumeByte == 0 {
+		if size := d.probeRanges(ctx, httpCient); size > 0 {
+			if segments := splitSegments(size, d.Segments); len(segments) > 1 {
+				d.Lock()
+				d.Size = size
+				d.Unlock()
+				d.setSegments(segments)
+				return d.downloadSegments(ctx, httpCient)
+			}
+		}
 	}
 
-	httpCient := &http.Client{
-		// later add timeout or stall timeout
+	req, err := d.newRequest(ctx, http.MethodGet)
+	if err != nil {
+		return err
+	}
 
+	if resumeByte > 0 {
+		d.setRange(req, resumeByte, -1)
 	}
 
 	// send request
-	resp, err := httpCient.Do(req)
+	resp, err := d.do(httpCient, req)
 	if err != nil {
-		d.setError(err)
-		return
+		return err
 	}
 
 	defer resp.Body.Close()
 
-	fmt.Printf("creating file: %s\n", d.Filepath)
+	// check what server really sent, only 206 with matching range can be appended
+	size := resp.ContentLength
+	switch {
+	case resumeByte > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		_, _, total, _ := parseContentRange(resp.Header.Get("Content-Range"))
+		// whole file is already on disk, size of part file alone does not prove it
+		d.Lock()
+		complete := total == resumeByte && d.Downloaded == total
+		d.Unlock()
+		if complete {
+			d.Lock()
+			d.Size = total
+			d.Downloaded = total
+			d.Unlock()
+			return nil
+		}
+		// local file is bigger than remote one
+		if err := d.resetProgress(); err != nil {
+			return err
+		}
+		return errRemoteChanged
+
+	case resumeByte > 0 && resp.StatusCode == http.StatusPartialContent:
+		start, end, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return rangeError(resp, "%v", err)
+		}
+		if start != resumeByte {
+			return rangeError(resp, "server sent range from byte %d, expected %d", start, resumeByte)
+		}
+		// shorter range is allowed by http, but rest of file would be missing
+		if total > 0 && end != total-1 {
+			return rangeError(resp, "server sent range %d-%d/%d, expected it to end at %d", start, end, total, total-1)
+		}
+		size = total
+
+	// error pages must not be saved as downloaded file
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return newStatusError(resp)
+
+	case resumeByte > 0:
+		// range ignored or If-Range did not match, body is whole new file
+		d.logger().Info("server sent whole file, restarting from beginning")
+		resumeByte = 0
+		d.rememberValidator(resp)
+
+	default:
+		d.rememberValidator(resp)
+	}
+
+	// nothing is on disk yet, so download can still get name from response
+	if resumeByte == 0 {
+		d.resolveFilename(resp)
+	}
+
+	d.logger().Debug("creating file", "path", d.partPath())
 
-	// keep if exists, otherwise create
-	file, err := os.OpenFile(d.Filepath, os.O_CREATE|os.O_WRONLY, 0644)
+	// keep if exists, otherwise create, restarted download overwrites old data
+	flags := os.O_CREATE | os.O_WRONLY
+	if resumeByte == 0 {
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(d.partPath(), flags, 0644)
 	if err != nil {
-		d.setError(err)
-		return
+		return err
 	}
 
 	defer file.Close()
@@ -134,58 +494,60 @@ func (d *DownloadItem) download() {
 	if resumeByte > 0 {
 		_, err := file.Seek(resumeByte, 0)
 		if err != nil {
-			d.setError(err)
-			return
+			return err
 		}
 	}
 
+	// continue hashing from data already on disk
+	if err := d.startStreamHash(resumeByte); err != nil {
+		return err
+	}
+
 	// set flags, so they represent actively downloading
 	d.Lock()
-	d.Size = resp.ContentLength + resumeByte
+	d.Size = size
 	d.Downloaded = resumeByte
-	d.Active = true
-	d.Err = nil
-	d.Completed = false
+	err = d.setActive()
 	d.Unlock()
+	if err != nil {
+		return err
+	}
+	d.activated()
+
+	body := d.limitReader(ctx, resp.Body)
 
 	//32k buffer
 	buf := make([]byte, 1024*32)
 
 	for {
-		num, err := resp.Body.Read(buf)
+		num, err := body.Read(buf)
 
 		if num > 0 {
 			_, writeErr := file.Write(buf[:num])
 			if writeErr != nil {
-				d.setError(writeErr)
-				return
+				return writeErr
+			}
+			if d.streamHash != nil {
+				d.streamHash.Write(buf[:num])
 			}
 			// update with mutex
 			d.Lock()
-			d.Downloaded += int64(num)
+			d.received(int64(num))
 			d.Unlock()
 		}
 
 		if err != nil {
-			// download finished
+			// download finished, unless body ended before known size
 			if err == io.EOF {
-				d.setDone()
-				return
-			}
-			// ctx used to slop download
-			if d.Ctx.Err() != nil {
-				if errors.Is(err, context.Canceled) {
-					// normal stop, do not set error
-					d.setStopped()
-					return
+				d.Lock()
+				short := d.Size > 0 && d.Downloaded < d.Size
+				d.Unlock()
+				if short {
+					return io.ErrUnexpectedEOF
 				}
-
-				d.setError(d.Ctx.Err())
-				return
+				return nil
 			}
-
-			d.setError(err)
-			return
+			return &bodyReadError{err}
 		}
 	}
 
@@ -0,0 +1,154 @@
+package downloader
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// server may answer open range with shorter one, download must not be completed with hole at the end
+func TestResumeRejectsShortRange(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 1000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "bytes=300-" {
+			w.Write(content)
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes 300-399/%d", len(content)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(content[300:400])
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	manager, err := NewDownloadManager(Config{
+		Segments:   1,
+		PartSuffix: ".part",
+		Retry:      RetryPolicy{MaxAttempts: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, unsubscribe := manager.Subscribe(EventCompleted, EventFailed)
+	defer unsubscribe()
+
+	// part file left by earlier run, it is created after add, so name is not taken
+	item := manager.AddDownload(server.URL+"/f.bin", dir, "f.bin", Options{})
+	if err := os.WriteFile(item.partPath(), content[:300], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.StartDownload(item); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-events:
+		if event.Type != EventFailed {
+			t.Fatalf("download ended with %s, expected failed", event.Type)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("download did not end")
+	}
+
+	item.Lock()
+	defer item.Unlock()
+	if !errors.Is(item.Err, errBadRange) {
+		t.Fatalf("expected range error, got %v", item.Err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "f.bin")); err == nil {
+		t.Fatal("incomplete file was renamed to final name")
+	}
+}
+
+// download is not split when server does not answer HEAD, its partial file has no holes,
+// so retry must append to it even though more segments are allowed
+func TestRetryResumesSingleStream(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 3*1024*1024/10)
+	cut := 1024 * 1024
+
+	var mu sync.Mutex
+	var ranges []string
+	var sent int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		first := len(ranges) == 1
+		mu.Unlock()
+
+		start := 0
+		if value, found := strings.CutPrefix(r.Header.Get("Range"), "bytes="); found {
+			start, _ = strconv.Atoi(strings.TrimSuffix(value, "-"))
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(content)-1, len(content)))
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)-start))
+			w.WriteHeader(http.StatusPartialContent)
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		}
+
+		// first body is cut, connection is closed before whole length is sent
+		body := content[start:]
+		if first {
+			body = body[:cut]
+		}
+		n, _ := w.Write(body)
+		mu.Lock()
+		sent += n
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	manager, err := NewDownloadManager(Config{
+		Segments:   4,
+		PartSuffix: ".part",
+		Retry:      RetryPolicy{MaxAttempts: 2, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, unsubscribe := manager.Subscribe(EventCompleted, EventFailed)
+	defer unsubscribe()
+
+	item := manager.AddDownload(server.URL+"/f.bin", dir, "f.bin", Options{})
+	if err := manager.StartDownload(item); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-events:
+		if event.Type != EventCompleted {
+			t.Fatalf("download ended with %s, expected completed", event.Type)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("download did not end")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ranges) != 2 || ranges[1] != fmt.Sprintf("bytes=%d-", cut) {
+		t.Fatalf("expected retry to resume from byte %d, got ranges %q", cut, ranges)
+	}
+	if sent != len(content) {
+		t.Fatalf("server sent %d bytes, expected %d", sent, len(content))
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "f.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Fatal("downloaded file differs from content")
+	}
+}
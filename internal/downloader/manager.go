@@ -3,99 +3,460 @@ package downloader
 import (
 	"context"
 	"fmt"
+	"log/slog"
+	"net/http"
 	"sync"
+	"time"
 
 	"github.com/matejeliash/medownloader/internal/dto"
 )
 
+// how often progress of running downloads is written to state file
+const saveInterval = 5 * time.Second
+
+// server-wide settings used for every download
+type Config struct {
+	Segments   int    // default number of parallel connections per download
+	DataDir    string // directory for state file, empty disables persistence
+	MaxActive  int    // max number of running downloads, 0 means no limit
+	RateLimit  int64  // bytes per second shared by all downloads, 0 means no limit
+	Retry      RetryPolicy
+	Timeouts   Timeouts
+	PartSuffix string      // appended to file name while downloading, empty writes directly to final file
+	Headers    http.Header // sent with every download, e.g. User-Agent
+
+	// proxy url for all downloads, empty uses HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+	Proxy      string
+	ProxyRules []ProxyRule // proxies for matching hosts, they take precedence over Proxy
+
+	Transport TransportConfig
+
+	TLS      TLSConfig
+	TLSRules []TLSRule // tls settings for matching hosts, they take precedence over TLS
+}
+
+// per-download settings, zero values fall back to Config
+type Options struct {
+	Segments    int
+	RateLimit   int64       // bytes per second, 0 means no limit
+	MaxAttempts int         // overrides Config.Retry.MaxAttempts
+	Checksum    string      // expected digest as algorithm:hex, validate with ParseChecksum
+	Headers     http.Header // custom headers and cookie, validate with ParseHeaders
+	Auth        *Auth       // nil when no credentials are needed, validate with ParseAuth
+	Proxy       string      // overrides Config.Proxy and rules, validate with ParseProxy
+	TLS         *TLSConfig  // overrides Config.TLS and rules, validate with NewTLSConfig
+	Schedule    *Schedule   // nil means download can run any time
+	Priority    int         // higher starts first, default is 0
+
+	// name was not chosen by user, it is replaced by name from server response
+	AutoFilename bool
+}
+
 type DownloadManager struct {
 	Downloads []*DownloadItem
 	idGetter  int64 // variable for setting download id
+	config    Config
+	store     *store       // nil when persistence is disabled
+	limiter   *rateLimiter // global bandwidth limit
+	meter     *speedMeter  // speed of all downloads
+	noProxy   string       // hosts excluded from Config.Proxy
+	client    *http.Client // shared by all downloads, so connections are reused
+	events    *eventHub
+	stats     *stats
 	sync.Mutex
 }
 
-func NewDownloadManager() *DownloadManager {
-	return &DownloadManager{
+// create manager, reload saved downloads and resume those that were active
+func NewDownloadManager(config Config) (*DownloadManager, error) {
+	if config.Segments < 1 {
+		config.Segments = 1
+	}
+	if config.MaxActive < 0 {
+		config.MaxActive = 0
+	}
+	if config.Retry.MaxAttempts < 1 {
+		config.Retry.MaxAttempts = 1
+	}
+	if config.Proxy != "" {
+		if _, err := ParseProxy(config.Proxy); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := NewTLSConfig(config.TLS); err != nil {
+		return nil, err
+	}
+
+	d := &DownloadManager{
 		Downloads: []*DownloadItem{},
 		idGetter:  0,
+		config:    config,
+		limiter:   newRateLimiter(config.RateLimit),
+		meter:     newSpeedMeter(),
+		noProxy:   noProxyFromEnv(),
+		events:    newEventHub(),
+		stats:     newStats(),
+	}
+	d.client = d.newHTTPClient()
+
+	// loops are started only for returned manager, so failed load leaks nothing
+	if config.DataDir == "" {
+		go d.scheduleLoop()
+		go d.progressLoop()
+		return d, nil
+	}
+
+	store, err := newStore(config.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	d.store = store
+
+	state, err := store.load()
+	if err != nil {
+		return nil, fmt.Errorf("could not load saved downloads: %w", err)
+	}
+
+	d.idGetter = state.NextId
+	for _, itemState := range state.Downloads {
+		item := newItemFromState(itemState)
+		item.Ctx, item.Cancel = context.WithCancel(context.Background())
+		item.onActive = d.save
+		item.events = d.events
+		item.globalLimiter = d.limiter
+		item.globalMeter = d.meter
+		item.stats = d.stats
+		item.defaultHeaders = config.Headers
+		item.client = d.client
+		item.retry = d.retryPolicy(itemState.MaxAttempts)
+		item.timeouts = config.Timeouts
+		item.rename = d.renameItem
+		d.Downloads = append(d.Downloads, item)
+
+		// download list is saved while running, so its segment map is newer,
+		// state next to part file only helps when list has none
+		if item.State != StateCompleted && len(item.segments) == 0 {
+			if err := item.loadResumeState(); err != nil {
+				item.logger().Warn("could not load resume state", "err", err)
+			}
+		}
+
+		// items running or waiting before shutdown continue from partial file,
+		// state is set directly, there is no goroutine which could see it
+		switch item.State {
+		case StateConnecting, StateDownloading, StateRetrying, StateVerifying:
+			item.State = StateQueued
+		}
+	}
+
+	d.Lock()
+	d.sortByPriority()
+	d.applySchedules()
+	d.schedule()
+	d.Unlock()
+
+	go d.saveLoop()
+	go d.scheduleLoop()
+	go d.progressLoop()
+
+	return d, nil
+}
+
+// server retry policy with optional max attempts of single download
+func (d *DownloadManager) retryPolicy(maxAttempts int) RetryPolicy {
+	policy := d.config.Retry
+	if maxAttempts > 0 {
+		policy.MaxAttempts = maxAttempts
+	}
+	return policy
+}
+
+// run download, then give its slot to next queued item and save state
+func (d *DownloadManager) run(item *DownloadItem) {
+	item.download()
+
+	d.Lock()
+	item.running = false
+	d.schedule()
+	d.Unlock()
+
+	d.save()
+}
+
+// periodically save progress, so restart loses as little as possible
+func (d *DownloadManager) saveLoop() {
+	ticker := time.NewTicker(saveInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if d.hasActive() {
+			d.save()
+		}
 	}
 }
 
-// resume download by creating  new ctx
-func (d *DownloadManager) ResumeDownload(id int64) {
+func (d *DownloadManager) hasActive() bool {
 	d.Lock()
 	defer d.Unlock()
+	for _, item := range d.Downloads {
+		item.Lock()
+		active := item.State == StateDownloading
+		item.Unlock()
+		if active {
+			return true
+		}
+	}
+	return false
+}
 
+// write all downloads into state file
+func (d *DownloadManager) save() {
+	if d.store == nil {
+		return
+	}
+
+	d.Lock()
+	state := managerState{
+		NextId:    d.idGetter,
+		Downloads: make([]itemState, 0, len(d.Downloads)),
+	}
 	for _, item := range d.Downloads {
-		if item.Id == id {
-			ctx, cancel := context.WithCancel(context.Background())
-			item.changeCtx(ctx, cancel)
-			// run in background
-			go item.download()
+		state.Downloads = append(state.Downloads, item.getState())
+	}
+	d.Unlock()
 
-		}
+	if err := d.store.save(state); err != nil {
+		slog.Error("could not save downloads", "err", err)
 	}
 }
 
+// resume download by creating  new ctx and putting it back to queue
+func (d *DownloadManager) ResumeDownload(id int64) error {
+	d.Lock()
+	defer d.Unlock()
+
+	item := d.findItem(id)
+	if item == nil {
+		return fmt.Errorf("downloadItem with id: %d not found", id)
+	}
+	return d.resume(item)
+}
+
+// must be called with manager locked
+func (d *DownloadManager) resume(item *DownloadItem) error {
+	// stopped item can still have goroutine, do not start second one
+	if item.running {
+		return fmt.Errorf("%w: download %d is still stopping", ErrInvalidTransition, item.Id)
+	}
+
+	item.Lock()
+	verificationFailed := item.VerificationFailed
+	item.Unlock()
+	// verification failed item is finished, it needs to be added again
+	if verificationFailed {
+		return fmt.Errorf("%w: download %d failed verification, add it again", ErrInvalidTransition, item.Id)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	item.changeCtx(ctx, cancel)
+	return d.enqueue(item)
+}
+
 // add download to slice !!! not starting just adding
-func (d *DownloadManager) AddDownload(url, filepath, filename string) *DownloadItem {
+// filename gets time prefix if it is already taken in dir
+func (d *DownloadManager) AddDownload(url, dir, filename string, opts Options) *DownloadItem {
 	d.Lock()
 	defer d.Unlock()
+	return d.addDownload(url, dir, filename, opts)
+}
+
+// download for AddDownloads
+type NewDownload struct {
+	Url      string
+	Dir      string
+	Filename string
+	Opts     Options
+}
+
+// add and start many downloads under single lock, list is saved only once,
+// returned errors are by index, item which could not be started stays paused
+func (d *DownloadManager) AddDownloads(downloads []NewDownload) ([]*DownloadItem, []error) {
+	items := make([]*DownloadItem, len(downloads))
+	errs := make([]error, len(downloads))
+
+	d.Lock()
+	for i, download := range downloads {
+		items[i] = d.addDownload(download.Url, download.Dir, download.Filename, download.Opts)
+		errs[i] = d.enqueue(items[i])
+	}
+	d.Unlock()
+
+	d.save()
+	return items, errs
+}
+
+// must be called with manager locked
+func (d *DownloadManager) addDownload(url, dir, filename string, opts Options) *DownloadItem {
+	filename, path := d.freePath(dir, filename, nil)
 
 	ctx, cancel := context.WithCancel(context.Background())
 
+	segments := opts.Segments
+	if segments < 1 {
+		segments = d.config.Segments
+	}
+
+	// empty settings would only hide host rules
+	if opts.TLS != nil && opts.TLS.isZero() {
+		opts.TLS = nil
+	}
+
+	// already validated by caller, invalid checksum is ignored
+	algorithm, checksum, _ := ParseChecksum(opts.Checksum)
+
 	downloadItem := &DownloadItem{
-		Id:       d.idGetter,
-		Url:      url,
-		Filepath: filepath,
-		Filename: filename,
-		Ctx:      ctx,
-		Cancel:   cancel,
+		Id:         d.idGetter,
+		State:      StatePaused,
+		Url:        url,
+		Filepath:   path,
+		Filename:   filename,
+		Segments:   segments,
+		PartSuffix: d.config.PartSuffix,
+		Priority:   opts.Priority,
+		Ctx:        ctx,
+
+		AutoFilename: opts.AutoFilename,
+		rename:       d.renameItem,
+		Cancel:       cancel,
+		onActive:     d.save,
+		events:       d.events,
+
+		limiter:       newRateLimiter(opts.RateLimit),
+		globalLimiter: d.limiter,
+		meter:         newSpeedMeter(),
+		globalMeter:   d.meter,
+		stats:         d.stats,
+
+		Headers:        opts.Headers,
+		auth:           opts.Auth,
+		Proxy:          opts.Proxy,
+		TLS:            opts.TLS,
+		Schedule:       opts.Schedule,
+		client:         d.client,
+		defaultHeaders: d.config.Headers,
+		retry:          d.retryPolicy(opts.MaxAttempts),
+		timeouts:       d.config.Timeouts,
+
+		ChecksumAlgorithm: algorithm,
+		Checksum:          checksum,
 	}
 	// !!! must increment
 	d.idGetter++
 
-	d.Downloads = append(d.Downloads, downloadItem)
+	d.insertByPriority(downloadItem)
+
+	data := downloadItem.getData()
+	d.events.publish(Event{Type: EventAdded, Id: downloadItem.Id, Item: &data})
 	return downloadItem
 }
 
-// stop download by canceling ctx
-func (d *DownloadManager) StopDownload(downloadItem *DownloadItem) {
-	if downloadItem.Cancel != nil {
-		downloadItem.Cancel()
+// stop download by canceling ctx or remove it from queue
+func (d *DownloadManager) StopDownload(downloadItem *DownloadItem) error {
+	d.Lock()
+	defer d.Unlock()
+	return d.stop(downloadItem)
+}
+
+// item is paused right away, its goroutine just ends
+// must be called with manager locked
+func (d *DownloadManager) stop(item *DownloadItem) error {
+	item.Lock()
+	err := item.setState(StatePaused, nil)
+	item.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if item.running && item.Cancel != nil {
+		item.Cancel()
+	}
+	return nil
+}
+
+// stop running or waiting download, resume paused or failed one,
+// both are decided under manager lock, so double click can't start download twice
+func (d *DownloadManager) ToggleDownload(id int64) (State, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	item := d.findItem(id)
+	if item == nil {
+		return "", fmt.Errorf("downloadItem with id: %d not found", id)
+	}
+
+	item.Lock()
+	state := item.State
+	item.Unlock()
+
+	var err error
+	if state.stoppable() {
+		err = d.stop(item)
+	} else {
+		err = d.resume(item)
 	}
 
+	item.Lock()
+	defer item.Unlock()
+	return item.State, err
 }
 
 // delete download from slice
 func (d *DownloadManager) DeleteDownload(id int64) error {
 	d.Lock()
-	defer d.Unlock()
 	for i, item := range d.Downloads {
 		if item.Id == id {
-			// cancel ctx in still downloading
-			if item.Active {
+			item.Lock()
+			completed := item.State == StateCompleted
+			item.setState(StateCancelled, nil)
+			item.Unlock()
+
+			// cancel ctx in still downloading, goroutine removes part file when it ends
+			if item.running {
 				item.Cancel()
+			} else if !completed {
+				item.removePartFile()
 			}
 
 			d.Downloads = append(d.Downloads[:i], d.Downloads[i+1:]...)
+			d.schedule()
+			d.Unlock()
+			d.save()
 			return nil
 
 		}
 	}
+	d.Unlock()
 
 	return fmt.Errorf("downloadItem with id: %d not found\n", id)
 }
 
-// start download in background
-func (d *DownloadManager) StartDownload(item *DownloadItem) {
-	go item.download()
+// put download into queue, it starts when there is free slot
+func (d *DownloadManager) StartDownload(item *DownloadItem) error {
+	d.Lock()
+	err := d.enqueue(item)
+	d.Unlock()
+
+	d.save()
+	return err
 }
 
 func (d *DownloadManager) GetItemById(id int64) *DownloadItem {
 	d.Lock()
 	defer d.Unlock()
+	return d.findItem(id)
+}
 
+// must be called with manager locked
+func (d *DownloadManager) findItem(id int64) *DownloadItem {
 	for _, item := range d.Downloads {
 		if item.Id == id {
 			return item
@@ -105,16 +466,25 @@ func (d *DownloadManager) GetItemById(id int64) *DownloadItem {
 	return nil
 }
 
-// get all downloading as snapshot,
+// get all downloading as snapshot, in queue order
 func (d *DownloadManager) GetAllDownloads() []dto.DownloadItemDto {
 	d.Lock()
 	defer d.Unlock()
 	dtos := make([]dto.DownloadItemDto, 0, len(d.Downloads))
+	position := 0
 	for _, item := range d.Downloads {
+		data := item.getData()
+		// position is counted only for waiting items, starting with 1
+		if data.Queued {
+			position++
+			data.QueuePosition = position
+		}
 		// append increases the length automatically
-		dtos = append(dtos, item.getData())
+		dtos = append(dtos, data)
 	}
 
+	fillEffectiveRateLimits(dtos, d.limiter.getRate())
+
 	return dtos
 
 }
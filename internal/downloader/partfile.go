@@ -0,0 +1,147 @@
+package downloader
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// suffix of resume state file saved next to part file
+const resumeStateSuffix = ".state"
+
+// resume data of unfinished download, saved next to part file
+type resumeState struct {
+	Url          string     `json:"url"`
+	Size         int64      `json:"size"`
+	ETag         string     `json:"etag,omitempty"`
+	LastModified string     `json:"lastModified,omitempty"`
+	Parts        []*segment `json:"parts,omitempty"`
+}
+
+// file with data while downloading, renamed to Filepath when done
+func (d *DownloadItem) partPath() string {
+	return d.Filepath + d.PartSuffix
+}
+
+func (d *DownloadItem) resumeStatePath() string {
+	return d.partPath() + resumeStateSuffix
+}
+
+// write segments and validators next to part file of stopped or retrying download,
+// other downloads have nothing to resume or keep it in download list
+func (d *DownloadItem) saveResumeState() error {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+
+	if _, err := os.Stat(d.partPath()); err != nil {
+		return nil
+	}
+
+	d.Lock()
+	if d.State != StatePaused && d.State != StateScheduled && d.State != StateRetrying {
+		d.Unlock()
+		return nil
+	}
+	state := resumeState{
+		Url:          d.Url,
+		Size:         d.Size,
+		ETag:         d.ETag,
+		LastModified: d.LastModified,
+	}
+	// copy segments, they are still changing while downloading
+	for _, s := range d.segments {
+		part := *s
+		state.Parts = append(state.Parts, &part)
+	}
+	d.Unlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := d.resumeStatePath() + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, d.resumeStatePath())
+}
+
+// read resume data saved by previous run, state of other url is ignored
+func (d *DownloadItem) loadResumeState() error {
+	data, err := os.ReadFile(d.resumeStatePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var state resumeState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	if state.Url != d.Url {
+		return nil
+	}
+
+	d.Lock()
+	d.Size = state.Size
+	d.ETag = state.ETag
+	d.LastModified = state.LastModified
+	d.segments = state.Parts
+	d.Unlock()
+	return nil
+}
+
+// save resume state, failure only costs progress of segments, so it is just logged
+func (d *DownloadItem) keepResumeState() {
+	if err := d.saveResumeState(); err != nil {
+		d.logger().Warn("could not save resume state", "err", err)
+	}
+}
+
+func (d *DownloadItem) removeResumeState() {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	os.Remove(d.resumeStatePath())
+}
+
+// remove data of deleted download, finished file is never part file unless suffix is empty,
+// so caller must not call it for completed download
+func (d *DownloadItem) removePartFile() {
+	d.removeResumeState()
+	os.Remove(d.partPath())
+}
+
+// flush part file to disk and atomically rename it to final name,
+// so programs watching download dir never see half written file
+func (d *DownloadItem) finish() error {
+	if d.partPath() == d.Filepath {
+		return nil
+	}
+
+	file, err := os.OpenFile(d.partPath(), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(d.partPath(), d.Filepath); err != nil {
+		return err
+	}
+
+	// persist rename itself, not supported everywhere, so error is ignored
+	if dir, err := os.Open(filepath.Dir(d.Filepath)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package downloader
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// proxy value which sends download directly, even if global proxy is set
+const ProxyDirect = "direct"
+
+// proxy for hosts matching pattern, e.g. *.corp.local -> http://proxy:3128
+type ProxyRule struct {
+	Pattern string // glob matched against host without port
+	Proxy   string // proxy url or direct
+}
+
+// check proxy url, nil is returned for direct connection
+func ParseProxy(rawProxy string) (*url.URL, error) {
+	rawProxy = strings.TrimSpace(rawProxy)
+	if strings.EqualFold(rawProxy, ProxyDirect) {
+		return nil, nil
+	}
+
+	proxyUrl, err := url.Parse(rawProxy)
+	if err != nil || proxyUrl.Host == "" {
+		return nil, fmt.Errorf("invalid proxy url: %s", redactProxy(rawProxy))
+	}
+
+	// http and https proxies use CONNECT for https downloads
+	switch proxyUrl.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme: %s", proxyUrl.Scheme)
+	}
+	return proxyUrl, nil
+}
+
+// parse rules in form "pattern=proxy, pattern=proxy"
+func ParseProxyRules(rawRules string) ([]ProxyRule, error) {
+	var rules []ProxyRule
+	for _, rawRule := range strings.Split(rawRules, ",") {
+		if strings.TrimSpace(rawRule) == "" {
+			continue
+		}
+		pattern, proxy, found := strings.Cut(rawRule, "=")
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if !found || pattern == "" {
+			return nil, fmt.Errorf("proxy rule must be in form pattern=proxy, got %q", redactProxy(rawRule))
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid proxy rule pattern: %s", pattern)
+		}
+		if _, err := ParseProxy(proxy); err != nil {
+			return nil, err
+		}
+		rules = append(rules, ProxyRule{Pattern: pattern, Proxy: strings.TrimSpace(proxy)})
+	}
+	return rules, nil
+}
+
+// proxy url without password, safe for logs and clients
+func redactProxy(rawProxy string) string {
+	proxyUrl, err := url.Parse(strings.TrimSpace(rawProxy))
+	if err != nil {
+		// can't find password, so nothing is shown
+		return "[invalid]"
+	}
+	return proxyUrl.Redacted()
+}
+
+// find if host is excluded from proxy by NO_PROXY list,
+// entries are hosts with subdomains, ip addresses, cidr ranges or *
+func matchNoProxy(noProxy, host string) bool {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		// port in entry is ignored
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+		entry = strings.TrimPrefix(entry, "*")
+		if host == strings.TrimPrefix(entry, ".") || strings.HasSuffix(host, "."+strings.TrimPrefix(entry, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// pick proxy for request, order is download override, host rules, global proxy,
+// global proxy falls back to HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+func (d *DownloadManager) proxyFor(item *DownloadItem, req *http.Request) (*url.URL, error) {
+	if item.Proxy != "" {
+		return ParseProxy(item.Proxy)
+	}
+
+	host := strings.ToLower(req.URL.Hostname())
+	for _, rule := range d.config.ProxyRules {
+		if matched, _ := path.Match(rule.Pattern, host); matched {
+			return ParseProxy(rule.Proxy)
+		}
+	}
+
+	if d.config.Proxy == "" {
+		return http.ProxyFromEnvironment(req)
+	}
+	if matchNoProxy(d.noProxy, host) {
+		return nil, nil
+	}
+	return ParseProxy(d.config.Proxy)
+}
+
+// proxy override for dto, password is hidden
+// must be called with item locked
+func (d *DownloadItem) redactedProxy() string {
+	if d.Proxy == "" || strings.EqualFold(d.Proxy, ProxyDirect) {
+		return d.Proxy
+	}
+	return redactProxy(d.Proxy)
+}
+
+// NO_PROXY from environment, used together with proxy from config
+func noProxyFromEnv() string {
+	if noProxy := os.Getenv("NO_PROXY"); noProxy != "" {
+		return noProxy
+	}
+	return os.Getenv("no_proxy")
+}
@@ -0,0 +1,144 @@
+package downloader
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+// put item into queue, scheduler starts it when there is free slot
+// must be called with manager locked
+func (d *DownloadManager) enqueue(item *DownloadItem) error {
+	item.Lock()
+	err := item.setState(StateQueued, nil)
+	item.Unlock()
+	if err != nil {
+		return err
+	}
+	d.schedule()
+	return nil
+}
+
+// start queued items while number of running downloads is under limit,
+// queue order is order of items in Downloads slice, it is sorted by priority
+// must be called with manager locked
+func (d *DownloadManager) schedule() {
+	running := 0
+	for _, item := range d.Downloads {
+		if item.running {
+			running++
+		}
+	}
+
+	for _, item := range d.Downloads {
+		if d.config.MaxActive > 0 && running >= d.config.MaxActive {
+			return
+		}
+
+		item.Lock()
+		if item.State != StateQueued {
+			item.Unlock()
+			continue
+		}
+		// outside of its schedule item waits until scheduleLoop queues it again
+		if !item.Schedule.allows(time.Now()) {
+			item.setState(StateScheduled, nil)
+			item.Unlock()
+			continue
+		}
+		item.setState(StateConnecting, nil)
+		item.Unlock()
+
+		item.running = true
+		running++
+		go d.run(item)
+	}
+}
+
+// change max number of running downloads, 0 means no limit
+// lowering limit does not stop running downloads, they just finish
+func (d *DownloadManager) SetMaxActive(maxActive int) {
+	d.Lock()
+	defer d.Unlock()
+
+	if maxActive < 0 {
+		maxActive = 0
+	}
+	d.config.MaxActive = maxActive
+	d.schedule()
+}
+
+func (d *DownloadManager) MaxActive() int {
+	d.Lock()
+	defer d.Unlock()
+	return d.config.MaxActive
+}
+
+// put item after all items with the same or higher priority, so it is last of its group
+// must be called with manager locked
+func (d *DownloadManager) insertByPriority(item *DownloadItem) {
+	i := len(d.Downloads)
+	for i > 0 && d.Downloads[i-1].Priority < item.Priority {
+		i--
+	}
+	d.Downloads = slices.Insert(d.Downloads, i, item)
+}
+
+// sort items loaded from older state without priorities
+// must be called with manager locked
+func (d *DownloadManager) sortByPriority() {
+	slices.SortStableFunc(d.Downloads, func(a, b *DownloadItem) int {
+		return b.Priority - a.Priority
+	})
+}
+
+// change priority of download, it moves to the end of items with the same priority
+func (d *DownloadManager) SetItemPriority(id int64, priority int) error {
+	d.Lock()
+	i := slices.IndexFunc(d.Downloads, func(item *DownloadItem) bool { return item.Id == id })
+	if i < 0 {
+		d.Unlock()
+		return fmt.Errorf("downloadItem with id: %d not found", id)
+	}
+
+	item := d.Downloads[i]
+	d.Downloads = slices.Delete(d.Downloads, i, i+1)
+	item.Lock()
+	item.Priority = priority
+	item.Unlock()
+	d.insertByPriority(item)
+	d.Unlock()
+
+	d.save()
+	return nil
+}
+
+// move download to position in list, starting with 1, position out of range
+// moves it to top or bottom, priority is changed to fit between new neighbours,
+// so moved item really starts before items below it
+func (d *DownloadManager) MoveDownload(id int64, position int) error {
+	d.Lock()
+	i := slices.IndexFunc(d.Downloads, func(item *DownloadItem) bool { return item.Id == id })
+	if i < 0 {
+		d.Unlock()
+		return fmt.Errorf("downloadItem with id: %d not found", id)
+	}
+
+	item := d.Downloads[i]
+	d.Downloads = slices.Delete(d.Downloads, i, i+1)
+	position = min(max(position, 1), len(d.Downloads)+1)
+	d.Downloads = slices.Insert(d.Downloads, position-1, item)
+
+	item.Lock()
+	if position > 1 {
+		item.Priority = min(item.Priority, d.Downloads[position-2].Priority)
+	}
+	if position < len(d.Downloads) {
+		item.Priority = max(item.Priority, d.Downloads[position].Priority)
+	}
+	item.Unlock()
+	d.Unlock()
+
+	d.save()
+	return nil
+}
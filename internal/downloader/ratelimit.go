@@ -0,0 +1,178 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/matejeliash/medownloader/internal/dto"
+)
+
+// token bucket limiting bytes per second, rate 0 means unlimited
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   int64   // bytes per second
+	tokens float64 // can go negative, debt is paid by sleeping
+	last   time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{
+		rate: max(rate, 0),
+		last: time.Now(),
+	}
+}
+
+// add tokens for time since last call, bucket holds at most one second of data
+// must be called with limiter locked
+func (l *rateLimiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	l.last = now
+}
+
+// change rate live, downloads using limiter are not interrupted
+func (l *rateLimiter) setRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.refill(now)
+	l.rate = max(rate, 0)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+}
+
+func (l *rateLimiter) getRate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// take n bytes from bucket and sleep if there is not enough of them
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	if l.rate == 0 {
+		l.last = time.Now()
+		l.mu.Unlock()
+		return nil
+	}
+
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reader throttled by all limiters, e.g. global and per-download one
+type limitedReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*rateLimiter
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	// read at most one second of data, so slow limit does not cause long pauses
+	for _, limiter := range l.limiters {
+		if rate := limiter.getRate(); rate > 0 && int64(len(p)) > rate {
+			p = p[:rate]
+		}
+	}
+
+	num, err := l.r.Read(p)
+	if num > 0 {
+		for _, limiter := range l.limiters {
+			if waitErr := limiter.wait(l.ctx, num); waitErr != nil {
+				return num, waitErr
+			}
+		}
+	}
+	return num, err
+}
+
+// wrap response body with global and item limiter
+func (d *DownloadItem) limitReader(ctx context.Context, r io.Reader) io.Reader {
+	limiters := []*rateLimiter{d.limiter}
+	if d.globalLimiter != nil {
+		limiters = append(limiters, d.globalLimiter)
+	}
+	return &limitedReader{ctx: ctx, r: r, limiters: limiters}
+}
+
+// split global limit between active downloads, bandwidth unused by items
+// with lower own limit goes to the others
+func fillEffectiveRateLimits(dtos []dto.DownloadItemDto, globalLimit int64) {
+	var active []*dto.DownloadItemDto
+	for i := range dtos {
+		dtos[i].EffectiveRateLimit = dtos[i].RateLimit
+		if dtos[i].Active {
+			active = append(active, &dtos[i])
+		}
+	}
+	if globalLimit == 0 || len(active) == 0 {
+		return
+	}
+
+	remaining := globalLimit
+	for len(active) > 0 {
+		share := remaining / int64(len(active))
+
+		// items limited below share keep their own limit
+		var rest []*dto.DownloadItemDto
+		for _, item := range active {
+			if item.RateLimit > 0 && item.RateLimit <= share {
+				remaining -= item.RateLimit
+			} else {
+				rest = append(rest, item)
+			}
+		}
+
+		if len(rest) == len(active) {
+			for _, item := range rest {
+				item.EffectiveRateLimit = share
+			}
+			return
+		}
+		active = rest
+	}
+}
+
+// change global bandwidth limit, running downloads slow down or speed up right away
+func (d *DownloadManager) SetRateLimit(limit int64) {
+	d.limiter.setRate(limit)
+}
+
+func (d *DownloadManager) RateLimit() int64 {
+	return d.limiter.getRate()
+}
+
+// change bandwidth limit of single download
+func (d *DownloadManager) SetItemRateLimit(id int64, limit int64) error {
+	item := d.GetItemById(id)
+	if item == nil {
+		return fmt.Errorf("downloadItem with id: %d not found", id)
+	}
+
+	item.limiter.setRate(limit)
+	d.save()
+	return nil
+}
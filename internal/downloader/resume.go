@@ -0,0 +1,100 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// file on server is not the one we started with, partial data was thrown away
+var errRemoteChanged = errors.New("remote file changed, download restarted from beginning")
+
+// remember ETag / Last-Modified of full response, used for If-Range on resume
+func (d *DownloadItem) rememberValidator(resp *http.Response) {
+	d.Lock()
+	defer d.Unlock()
+	d.ETag = resp.Header.Get("ETag")
+	d.LastModified = resp.Header.Get("Last-Modified")
+}
+
+// value for If-Range header, weak ETag can't be used there, so Last-Modified is fallback
+func (d *DownloadItem) ifRange() string {
+	d.Lock()
+	defer d.Unlock()
+	if d.ETag != "" && !strings.HasPrefix(d.ETag, "W/") {
+		return d.ETag
+	}
+	return d.LastModified
+}
+
+// set Range and If-Range, so server sends whole new file if it changed
+func (d *DownloadItem) setRange(req *http.Request, start, end int64) {
+	if end < 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", start))
+	} else {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	}
+	if validator := d.ifRange(); validator != "" {
+		req.Header.Set("If-Range", validator)
+	}
+}
+
+// throw away partial data, next attempt starts from zero
+func (d *DownloadItem) resetProgress() error {
+	d.Lock()
+	d.segments = nil
+	d.Downloaded = 0
+	d.ETag = ""
+	d.LastModified = ""
+	d.Unlock()
+
+	d.removeResumeState()
+	err := os.Truncate(d.partPath(), 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// parse Content-Range, e.g. "bytes 100-199/1000" or "bytes */1000" for 416,
+// total is -1 when server does not know it
+func parseContentRange(value string) (start, end, total int64, err error) {
+	invalid := fmt.Errorf("invalid Content-Range: %q", value)
+
+	rangePart, found := strings.CutPrefix(value, "bytes ")
+	if !found {
+		return 0, 0, 0, invalid
+	}
+	rangePart, totalPart, found := strings.Cut(rangePart, "/")
+	if !found {
+		return 0, 0, 0, invalid
+	}
+
+	total = -1
+	if totalPart != "*" {
+		if total, err = strconv.ParseInt(totalPart, 10, 64); err != nil {
+			return 0, 0, 0, invalid
+		}
+	}
+
+	// unsatisfied range has no start and end
+	if rangePart == "*" {
+		return -1, -1, total, nil
+	}
+
+	startPart, endPart, found := strings.Cut(rangePart, "-")
+	if !found {
+		return 0, 0, 0, invalid
+	}
+	if start, err = strconv.ParseInt(startPart, 10, 64); err != nil {
+		return 0, 0, 0, invalid
+	}
+	if end, err = strconv.ParseInt(endPart, 10, 64); err != nil || end < start {
+		return 0, 0, 0, invalid
+	}
+
+	return start, end, total, nil
+}
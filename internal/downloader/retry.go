@@ -0,0 +1,125 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// how failed attempts are retried, every retry resumes from data already on disk
+type RetryPolicy struct {
+	MaxAttempts int           // attempts including the first one, 1 disables retrying
+	BaseBackoff time.Duration // wait before first retry, doubled for every next one
+	MaxBackoff  time.Duration // upper bound of wait, Retry-After from server can exceed it
+}
+
+// error for response with status we did not expect
+type statusError struct {
+	StatusCode int
+	Status     string
+	RetryAfter time.Duration // parsed Retry-After header, 0 if missing
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("server responded with status: %s", e.Status)
+}
+
+func newStatusError(resp *http.Response) *statusError {
+	return &statusError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+// error while reading response body, connection broke after server started sending,
+// e.g. reset of http/2 stream or GOAWAY, these have no common type to check
+type bodyReadError struct {
+	err error
+}
+
+func (e *bodyReadError) Error() string {
+	return e.err.Error()
+}
+
+func (e *bodyReadError) Unwrap() error {
+	return e.err
+}
+
+// status codes worth trying again, server is overloaded or temporarily broken
+func isRetryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// Retry-After is either number of seconds or http date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
+}
+
+// transient failures: stalls, changed remote file, wrong range, connection reset / refused, timeouts, cut or broken body, 5xx and 429
+func isRetryable(err error) bool {
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return isRetryableStatus(statusErr.StatusCode)
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	// broken body is retried unless download was stopped or disk failed
+	var readErr *bodyReadError
+	if errors.As(err, &readErr) {
+		return !errors.Is(err, context.Canceled) &&
+			!errors.Is(err, context.DeadlineExceeded) &&
+			!isDiskError(err)
+	}
+
+	return errors.Is(err, errStalled) ||
+		errors.Is(err, errRemoteChanged) ||
+		errors.Is(err, errBadRange) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// exponential backoff with jitter, random value between half and full delay
+// so many failed downloads do not hit server at the same time
+func (p RetryPolicy) backoff(attempt int, err error) time.Duration {
+	var statusErr *statusError
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+		return statusErr.RetryAfter
+	}
+
+	delay := p.BaseBackoff
+	for i := 1; i < attempt && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	half := delay / 2
+	return half + rand.N(delay-half+1)
+}
@@ -0,0 +1,344 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matejeliash/medownloader/internal/dto"
+)
+
+// how often schedules are checked, windows have minute precision
+const scheduleInterval = 10 * time.Second
+
+// when download is allowed to run, times are in local time of server
+type Schedule struct {
+	StartAt time.Time `json:"startAt,omitzero"`  // zero means right away
+	Windows []Window  `json:"windows,omitempty"` // empty means any time
+}
+
+// daily time window, e.g. 01:00-07:00 mon-fri,
+// window with end before start goes over midnight, equal start and end is whole day
+type Window struct {
+	Start int     // minutes after midnight
+	End   int     // minutes after midnight
+	Days  [7]bool // by time.Weekday, day when window starts, all false means every day
+}
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// parse window in form "01:00-07:00", "01:00-07:00 mon-fri", "22:00-06:00 fri,sat" or just "weekends"
+func ParseWindow(s string) (Window, error) {
+	var w Window
+	fields := strings.Fields(strings.ToLower(s))
+	if len(fields) == 0 || len(fields) > 2 {
+		return w, fmt.Errorf("invalid window: %q", s)
+	}
+
+	rawDays := ""
+	if strings.Contains(fields[0], ":") {
+		rawStart, rawEnd, _ := strings.Cut(fields[0], "-")
+		start, errStart := parseClock(rawStart)
+		end, errEnd := parseClock(rawEnd)
+		if errStart != nil || errEnd != nil {
+			return w, fmt.Errorf("invalid window time: %q", fields[0])
+		}
+		w.Start, w.End = start, end
+		if len(fields) == 2 {
+			rawDays = fields[1]
+		}
+	} else if len(fields) == 1 {
+		rawDays = fields[0]
+	} else {
+		return w, fmt.Errorf("invalid window: %q", s)
+	}
+
+	if rawDays != "" {
+		days, err := parseDays(rawDays)
+		if err != nil {
+			return w, err
+		}
+		w.Days = days
+	}
+	return w, nil
+}
+
+// parse HH:MM, 24:00 is allowed as end of day
+func parseClock(s string) (int, error) {
+	rawHours, rawMinutes, found := strings.Cut(s, ":")
+	hours, errHours := strconv.Atoi(rawHours)
+	minutes, errMinutes := strconv.Atoi(rawMinutes)
+	if !found || errHours != nil || errMinutes != nil || hours < 0 || minutes < 0 || minutes > 59 {
+		return 0, fmt.Errorf("invalid time: %q", s)
+	}
+	if hours > 23 && !(hours == 24 && minutes == 0) {
+		return 0, fmt.Errorf("invalid time: %q", s)
+	}
+	return (hours*60 + minutes) % (24 * 60), nil
+}
+
+// parse list of days like "mon,wed", "mon-fri", "weekdays" or "weekends"
+func parseDays(s string) ([7]bool, error) {
+	var days [7]bool
+	for _, part := range strings.Split(s, ",") {
+		switch part {
+		case "daily":
+			days = [7]bool{true, true, true, true, true, true, true}
+			continue
+		case "weekdays":
+			part = "mon-fri"
+		case "weekends":
+			part = "sat-sun"
+		}
+
+		rawFirst, rawLast, isRange := strings.Cut(part, "-")
+		first := dayIndex(rawFirst)
+		last := first
+		if isRange {
+			last = dayIndex(rawLast)
+		}
+		if first < 0 || last < 0 {
+			return days, fmt.Errorf("invalid day: %q", part)
+		}
+
+		// range can wrap over end of week, e.g. sat-sun
+		for day := first; ; day = (day + 1) % 7 {
+			days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func dayIndex(name string) int {
+	for i, dayName := range weekdayNames {
+		if name == dayName {
+			return i
+		}
+	}
+	return -1
+}
+
+// create schedule from user input, nil is returned when there is nothing to wait for
+func ParseSchedule(startAt *time.Time, rawWindows []string) (*Schedule, error) {
+	schedule := &Schedule{}
+	if startAt != nil {
+		schedule.StartAt = *startAt
+	}
+	for _, rawWindow := range rawWindows {
+		if strings.TrimSpace(rawWindow) == "" {
+			continue
+		}
+		window, err := ParseWindow(rawWindow)
+		if err != nil {
+			return nil, err
+		}
+		schedule.Windows = append(schedule.Windows, window)
+	}
+
+	if schedule.StartAt.IsZero() && len(schedule.Windows) == 0 {
+		return nil, nil
+	}
+	return schedule, nil
+}
+
+// window in the same form as accepted by ParseWindow
+func (w Window) String() string {
+	s := fmt.Sprintf("%02d:%02d-%02d:%02d", w.Start/60, w.Start%60, w.End/60, w.End%60)
+
+	var days []string
+	for i, enabled := range w.Days {
+		if enabled {
+			days = append(days, weekdayNames[i])
+		}
+	}
+	if len(days) > 0 && len(days) < 7 {
+		s += " " + strings.Join(days, ",")
+	}
+	return s
+}
+
+// windows are saved as text
+func (w Window) MarshalText() ([]byte, error) {
+	return []byte(w.String()), nil
+}
+
+func (w *Window) UnmarshalText(data []byte) error {
+	window, err := ParseWindow(string(data))
+	if err != nil {
+		return err
+	}
+	*w = window
+	return nil
+}
+
+func (w Window) onDay(day time.Weekday) bool {
+	return w.Days == [7]bool{} || w.Days[day]
+}
+
+func (w Window) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	switch {
+	case w.Start == w.End:
+		return w.onDay(t.Weekday())
+	case w.Start < w.End:
+		return w.onDay(t.Weekday()) && minute >= w.Start && minute < w.End
+	default:
+		// part after midnight belongs to window of previous day
+		yesterday := (t.Weekday() + 6) % 7
+		return (w.onDay(t.Weekday()) && minute >= w.Start) || (w.onDay(yesterday) && minute < w.End)
+	}
+}
+
+// find if download can run at time t, nil schedule allows any time
+func (s *Schedule) allows(t time.Time) bool {
+	if s == nil {
+		return true
+	}
+	if t.Before(s.StartAt) {
+		return false
+	}
+	if len(s.Windows) == 0 {
+		return true
+	}
+	for _, window := range s.Windows {
+		if window.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// first time from now when download can run, zero if it can run now or never
+func (s *Schedule) next(now time.Time) time.Time {
+	if s.allows(now) {
+		return time.Time{}
+	}
+
+	// download can start only at start time or when some window opens,
+	// openings after far start time are searched from its date
+	candidates := []time.Time{s.StartAt}
+	days := []time.Time{now}
+	if s.StartAt.After(now) {
+		days = append(days, s.StartAt.In(now.Location()))
+	}
+	for _, day := range days {
+		for offset := 0; offset <= 7; offset++ {
+			for _, window := range s.Windows {
+				candidates = append(candidates, time.Date(day.Year(), day.Month(), day.Day()+offset,
+					window.Start/60, window.Start%60, 0, 0, now.Location()))
+			}
+		}
+	}
+
+	var next time.Time
+	for _, candidate := range candidates {
+		if !candidate.After(now) || !s.allows(candidate) {
+			continue
+		}
+		if next.IsZero() || candidate.Before(next) {
+			next = candidate
+		}
+	}
+	return next
+}
+
+// add schedule and next start to dto
+// must be called with item locked
+func (d *DownloadItem) fillSchedule(data *dto.DownloadItemDto) {
+	if d.Schedule == nil {
+		return
+	}
+
+	data.Schedule = &dto.ScheduleDto{Windows: []string{}}
+	if !d.Schedule.StartAt.IsZero() {
+		startAt := d.Schedule.StartAt
+		data.Schedule.StartAt = &startAt
+	}
+	for _, window := range d.Schedule.Windows {
+		data.Schedule.Windows = append(data.Schedule.Windows, window.String())
+	}
+
+	if d.State == StateScheduled {
+		if next := d.Schedule.next(time.Now()); !next.IsZero() {
+			data.NextStart = &next
+		}
+	}
+}
+
+// periodically start and pause downloads as their windows open and close
+func (d *DownloadManager) scheduleLoop() {
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		d.Lock()
+		changed := d.applySchedules()
+		d.Unlock()
+
+		if changed {
+			d.save()
+		}
+	}
+}
+
+// pause downloads outside of their schedule and queue waiting ones which can run,
+// returns true when some download changed
+// must be called with manager locked
+func (d *DownloadManager) applySchedules() bool {
+	now := time.Now()
+	changed := false
+
+	for _, item := range d.Downloads {
+		item.Lock()
+		state := item.State
+		allowed := item.Schedule.allows(now)
+		item.Unlock()
+
+		switch {
+		case state == StateScheduled && allowed && !item.running:
+			// window opened, download continues from partial file
+			ctx, cancel := context.WithCancel(context.Background())
+			item.changeCtx(ctx, cancel)
+			if err := d.enqueue(item); err == nil {
+				changed = true
+			}
+
+		case state.stoppable() && state != StateScheduled && !allowed:
+			// window closed, running goroutine ends and item waits for next one
+			item.Lock()
+			err := item.setState(StateScheduled, nil)
+			item.Unlock()
+			if err == nil {
+				if item.running {
+					item.Cancel()
+				}
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// change schedule of download, nil removes it, download is paused or started right away
+func (d *DownloadManager) SetItemSchedule(id int64, schedule *Schedule) error {
+	item := d.GetItemById(id)
+	if item == nil {
+		return fmt.Errorf("downloadItem with id: %d not found", id)
+	}
+
+	item.Lock()
+	item.Schedule = schedule
+	item.Unlock()
+
+	d.Lock()
+	d.applySchedules()
+	d.Unlock()
+
+	d.save()
+	return nil
+}
@@ -0,0 +1,236 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// segments smaller than this are not worth extra connection
+const minSegmentSize int64 = 1024 * 1024
+
+// one byte range of segmented download
+type segment struct {
+	Start int64 `json:"start"` // first byte of range
+	End   int64 `json:"end"`   // last byte of range, inclusive
+	Done  int64 `json:"done"`  // bytes already written from Start
+}
+
+func (s *segment) length() int64 {
+	return s.End - s.Start + 1
+}
+
+func (s *segment) finished() bool {
+	return s.Done >= s.length()
+}
+
+// split file of given size into count ranges, last one takes the remainder
+func splitSegments(size int64, count int) []*segment {
+	if max := int(size / minSegmentSize); count > max {
+		count = max
+	}
+	if count < 1 {
+		count = 1
+	}
+
+	partSize := size / int64(count)
+	segments := make([]*segment, 0, count)
+	var start int64 = 0
+	for i := 0; i < count; i++ {
+		end := start + partSize - 1
+		if i == count-1 {
+			end = size - 1
+		}
+		segments = append(segments, &segment{Start: start, End: end})
+		start = end + 1
+	}
+	return segments
+}
+
+// ask server with HEAD if it supports ranges and return file size,
+// size is -1 if download can't be split
+func (d *DownloadItem) probeRanges(ctx context.Context, client *http.Client) int64 {
+	req, err := d.newRequest(ctx, http.MethodHead)
+	if err != nil {
+		return -1
+	}
+
+	resp, err := d.do(client, req)
+	if err != nil {
+		return -1
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Accept-Ranges") != "bytes" {
+		return -1
+	}
+	d.rememberValidator(resp)
+	d.resolveFilename(resp)
+
+	return resp.ContentLength
+}
+
+// segments from previous run can be reused only if the file is still there
+func (d *DownloadItem) canResumeSegments() bool {
+	if len(d.segments) == 0 {
+		return false
+	}
+	info, err := os.Stat(d.partPath())
+	return err == nil && info.Size() == d.Size
+}
+
+// download all segments in parallel, every goroutine writes at its own offset
+func (d *DownloadItem) downloadSegments(parent context.Context, client *http.Client) error {
+
+	file, err := os.OpenFile(d.partPath(), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// allocate whole file so segments can write anywhere
+	if err := file.Truncate(d.Size); err != nil {
+		return err
+	}
+
+	d.Lock()
+	var downloaded int64 = 0
+	for _, s := range d.segments {
+		downloaded += s.Done
+	}
+	d.Downloaded = downloaded
+	err = d.setActive()
+	d.Unlock()
+	if err != nil {
+		return err
+	}
+	d.activated()
+
+	// first failing segment stops the others
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(d.segments))
+
+	for _, s := range d.segments {
+		if s.finished() {
+			continue
+		}
+		wg.Add(1)
+		go func(s *segment) {
+			defer wg.Done()
+			if err := d.downloadSegment(ctx, client, file, s); err != nil {
+				errs <- err
+				cancel()
+			}
+		}(s)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	// ctx used to stop download
+	if parent.Err() != nil {
+		return parent.Err()
+	}
+
+	// report first real error, canceled siblings are not interesting
+	for err := range errs {
+		if errors.Is(err, errRemoteChanged) {
+			if resetErr := d.resetProgress(); resetErr != nil {
+				return resetErr
+			}
+			return err
+		}
+		if !errors.Is(err, context.Canceled) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fetch single range and write it into file at segment offset
+func (d *DownloadItem) downloadSegment(ctx context.Context, client *http.Client, file *os.File, s *segment) error {
+	req, err := d.newRequest(ctx, http.MethodGet)
+	if err != nil {
+		return err
+	}
+
+	d.Lock()
+	offset := s.Start + s.Done
+	d.Unlock()
+	d.setRange(req, offset, s.End)
+
+	resp, err := d.do(client, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// full response means If-Range did not match, file changed since start
+	if resp.StatusCode == http.StatusOK {
+		return errRemoteChanged
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return newStatusError(resp)
+	}
+
+	start, end, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return rangeError(resp, "%v", err)
+	}
+	if start != offset || end != s.End || total != d.Size {
+		return rangeError(resp, "server sent range %d-%d/%d, expected %d-%d/%d", start, end, total, offset, s.End, d.Size)
+	}
+
+	body := d.limitReader(ctx, resp.Body)
+
+	//32k buffer
+	buf := make([]byte, 1024*32)
+
+	for {
+		// do not write past the end of segment
+		d.Lock()
+		remaining := s.length() - s.Done
+		d.Unlock()
+		if remaining <= 0 {
+			return nil
+		}
+		if int64(len(buf)) > remaining {
+			buf = buf[:remaining]
+		}
+
+		num, err := body.Read(buf)
+
+		if num > 0 {
+			_, writeErr := file.WriteAt(buf[:num], offset)
+			if writeErr != nil {
+				return writeErr
+			}
+			offset += int64(num)
+
+			d.Lock()
+			s.Done += int64(num)
+			d.received(int64(num))
+			d.Unlock()
+		}
+
+		if err != nil {
+			if err == io.EOF {
+				d.Lock()
+				finished := s.finished()
+				d.Unlock()
+				if !finished {
+					return io.ErrUnexpectedEOF
+				}
+				return nil
+			}
+			return &bodyReadError{err}
+		}
+	}
+}
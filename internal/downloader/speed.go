@@ -0,0 +1,192 @@
+package downloader
+
+import (
+	"sync"
+	"time"
+
+	"github.com/matejeliash/medownloader/internal/dto"
+)
+
+// current speed is average over this many last seconds
+const speedWindow = 5
+
+// rolling window of bytes received per second
+type speedMeter struct {
+	mu      sync.Mutex
+	buckets [speedWindow]int64
+	last    int64     // unix second of newest bucket
+	first   time.Time // first data since meter was idle, short history is not averaged over whole window
+}
+
+func newSpeedMeter() *speedMeter {
+	return &speedMeter{}
+}
+
+// drop buckets older than window
+// must be called with meter locked
+func (m *speedMeter) advance(now time.Time) {
+	sec := now.Unix()
+	if sec-m.last >= speedWindow {
+		m.buckets = [speedWindow]int64{}
+		m.first = time.Time{}
+	} else {
+		for s := m.last + 1; s <= sec; s++ {
+			m.buckets[s%speedWindow] = 0
+		}
+	}
+	if sec > m.last {
+		m.last = sec
+	}
+}
+
+func (m *speedMeter) add(n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.advance(now)
+	if m.first.IsZero() {
+		m.first = now
+	}
+	m.buckets[m.last%speedWindow] += n
+}
+
+// bytes per second over window, 0 when nothing came recently
+func (m *speedMeter) rate() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.advance(now)
+	if m.first.IsZero() {
+		return 0
+	}
+
+	var sum int64
+	for _, n := range m.buckets {
+		sum += n
+	}
+
+	// whole seconds in window plus part of current one
+	span := time.Duration(speedWindow-1)*time.Second + time.Duration(now.UnixNano()%int64(time.Second))
+	span = min(span, now.Sub(m.first))
+	span = max(span, time.Second)
+	return int64(float64(sum) / span.Seconds())
+}
+
+// count received bytes in progress and speed
+// must be called with item locked
+func (d *DownloadItem) received(n int64) {
+	d.Downloaded += n
+	d.Transferred += n
+	d.meter.add(n)
+	if d.globalMeter != nil {
+		d.globalMeter.add(n)
+	}
+	if d.stats != nil {
+		d.stats.addBytes(d.host(), n)
+	}
+}
+
+// start measuring active time
+// must be called with item locked
+func (d *DownloadItem) startClock() {
+	now := time.Now()
+	if d.StartedAt.IsZero() {
+		d.StartedAt = now
+	}
+	if d.activeSince.IsZero() {
+		d.activeSince = now
+	}
+	d.FinishedAt = time.Time{}
+}
+
+// add time since activation to active time
+// must be called with item locked
+func (d *DownloadItem) stopClock() {
+	if !d.activeSince.IsZero() {
+		d.ActiveTime += time.Since(d.activeSince)
+		d.activeSince = time.Time{}
+	}
+}
+
+// time spent downloading, waiting in queue or for retry is not counted
+// must be called with item locked
+func (d *DownloadItem) elapsed() time.Duration {
+	elapsed := d.ActiveTime
+	if !d.activeSince.IsZero() {
+		elapsed += time.Since(d.activeSince)
+	}
+	return elapsed
+}
+
+// fill speed, eta and times of dto
+// must be called with item locked
+func (d *DownloadItem) fillSpeed(data *dto.DownloadItemDto) {
+	elapsed := d.elapsed()
+	data.Elapsed = int64(elapsed.Seconds())
+	if elapsed >= time.Second {
+		data.AverageSpeed = int64(float64(d.Transferred) / elapsed.Seconds())
+	}
+
+	if d.State == StateDownloading {
+		data.Speed = d.meter.rate()
+		if d.Size > 0 && data.Speed > 0 {
+			eta := max(d.Size-d.Downloaded, 0) / data.Speed
+			data.Eta = &eta
+		}
+	}
+
+	if !d.StartedAt.IsZero() {
+		startedAt := d.StartedAt
+		data.StartedAt = &startedAt
+	}
+	if !d.FinishedAt.IsZero() {
+		finishedAt := d.FinishedAt
+		data.FinishedAt = &finishedAt
+	}
+}
+
+// totals over all downloads, eta counts only unfinished downloads of known size
+func (d *DownloadManager) Summary(downloads []dto.DownloadItemDto) dto.DownloadsSummaryDto {
+	summary := dto.DownloadsSummaryDto{
+		Total: len(downloads),
+		Speed: d.meter.rate(),
+	}
+
+	var remaining int64
+	for _, item := range downloads {
+		pending := false // downloads without user action, counted in eta
+		switch State(item.State) {
+		case StateCompleted:
+			summary.Completed++
+		case StateConnecting, StateDownloading, StateVerifying:
+			summary.Active++
+			pending = true
+		case StateQueued:
+			summary.Queued++
+			pending = true
+		case StateScheduled:
+			summary.Scheduled++
+		case StateRetrying:
+			summary.Retrying++
+			pending = true
+		case StateFailed:
+			summary.Failed++
+		}
+
+		summary.Downloaded += item.Downloaded
+		if item.Size > 0 {
+			summary.Size += item.Size
+		}
+		if pending && item.Size > 0 {
+			remaining += max(item.Size-item.Downloaded, 0)
+		}
+	}
+
+	if summary.Speed > 0 && remaining > 0 {
+		eta := remaining / summary.Speed
+		summary.Eta = &eta
+	}
+	return summary
+}
@@ -0,0 +1,68 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// attempt canceled by watchdog, it is retried like network error
+var errStalled = errors.New("download stalled, transfer too slow")
+
+// limits for connecting and for slow transfer, zero value disables the limit
+type Timeouts struct {
+	Dial           time.Duration // opening tcp connection
+	TLSHandshake   time.Duration
+	ResponseHeader time.Duration // waiting for response headers after request is sent
+	Stall          time.Duration // how long throughput can stay under StallSpeed
+	StallSpeed     int64         // bytes per second
+}
+
+// minimal speed for watchdog, limited download is expected to be slow,
+// so there only complete stall counts
+func (d *DownloadItem) stallSpeed() int64 {
+	if d.limiter.getRate() > 0 || (d.globalLimiter != nil && d.globalLimiter.getRate() > 0) {
+		return min(d.timeouts.StallSpeed, 1)
+	}
+	return d.timeouts.StallSpeed
+}
+
+// cancel attempt when average speed over stall window is under threshold
+func (d *DownloadItem) watchStall(ctx context.Context, cancel context.CancelCauseFunc) {
+	if d.timeouts.Stall <= 0 {
+		return
+	}
+
+	window := max(int(d.timeouts.Stall/time.Second), 1)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	// downloaded bytes sampled every second, window+1 samples cover whole window
+	samples := make([]int64, 0, window+1)
+	d.Lock()
+	samples = append(samples, d.Downloaded)
+	d.Unlock()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		d.Lock()
+		samples = append(samples, d.Downloaded)
+		d.Unlock()
+
+		if len(samples) <= window {
+			continue
+		}
+		samples = samples[1:]
+
+		speed := (samples[len(samples)-1] - samples[0]) / int64(window)
+		if speed < d.stallSpeed() {
+			cancel(errStalled)
+			return
+		}
+	}
+}
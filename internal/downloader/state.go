@@ -0,0 +1,88 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// state of download, it is changed only by setState, so every change is checked
+type State string
+
+const (
+	StatePaused      State = "paused"      // added or stopped by user, waits to be started
+	StateQueued      State = "queued"      // waits for free slot
+	StateScheduled   State = "scheduled"   // waits for start time or window of schedule
+	StateConnecting  State = "connecting"  // goroutine started, waits for response
+	StateDownloading State = "downloading" // data is flowing
+	StateRetrying    State = "retrying"    // attempt failed, waits for next one
+	StateVerifying   State = "verifying"   // whole file is on disk, checksum and rename
+	StateCompleted   State = "completed"
+	StateFailed      State = "failed"    // retries did not help, can be resumed unless verification failed
+	StateCancelled   State = "cancelled" // deleted, its goroutine is stopping
+)
+
+// all states in order of lifecycle
+var States = []State{
+	StatePaused, StateQueued, StateScheduled, StateConnecting, StateDownloading,
+	StateRetrying, StateVerifying, StateCompleted, StateFailed, StateCancelled,
+}
+
+// allowed changes of state, anything else is a bug or race and is refused
+var transitions = map[State][]State{
+	StatePaused:      {StateQueued, StateCancelled},
+	StateQueued:      {StateConnecting, StateScheduled, StatePaused, StateCancelled},
+	StateScheduled:   {StateQueued, StatePaused, StateCancelled},
+	StateConnecting:  {StateDownloading, StateRetrying, StateVerifying, StateFailed, StatePaused, StateScheduled, StateCancelled},
+	StateDownloading: {StateRetrying, StateVerifying, StateFailed, StatePaused, StateScheduled, StateCancelled},
+	StateRetrying:    {StateConnecting, StateFailed, StatePaused, StateScheduled, StateCancelled},
+	StateVerifying:   {StateCompleted, StateFailed, StateCancelled},
+	StateCompleted:   {StateCancelled},
+	StateFailed:      {StateQueued, StateCancelled},
+	StateCancelled:   {},
+}
+
+var ErrInvalidTransition = errors.New("invalid state transition")
+
+// download goroutine is working on item, user can stop it
+func (s State) stoppable() bool {
+	switch s {
+	case StateQueued, StateScheduled, StateConnecting, StateDownloading, StateRetrying:
+		return true
+	}
+	return false
+}
+
+// change state and fields which depend on it, change sets other fields
+// before subscribers get snapshot of item, it can be nil
+// must be called with item locked
+func (d *DownloadItem) setState(to State, change func()) error {
+	from := d.State
+	if !slices.Contains(transitions[from], to) {
+		return fmt.Errorf("%w: download %d can't go from %s to %s", ErrInvalidTransition, d.Id, from, to)
+	}
+
+	switch from {
+	case StateDownloading:
+		d.stopClock()
+	case StateRetrying:
+		d.NextRetry = time.Time{}
+	}
+
+	switch to {
+	case StateDownloading:
+		d.Err = nil
+		d.startClock()
+	case StateCompleted:
+		d.FinishedAt = time.Now()
+	}
+
+	d.logger().Debug("state changed", "from", from, "to", to)
+	d.State = to
+	if change != nil {
+		change()
+	}
+	d.publishState(from)
+	return nil
+}
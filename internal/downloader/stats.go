@@ -0,0 +1,67 @@
+package downloader
+
+import (
+	"cmp"
+	"maps"
+	"sync"
+)
+
+// counters of all downloads since start of server, they are not saved
+type stats struct {
+	mu        sync.Mutex
+	bytes     map[string]int64 // received bytes by host of download url
+	responses map[int]int64    // responses of download servers by status code
+	retries   int64
+}
+
+func newStats() *stats {
+	return &stats{
+		bytes:     map[string]int64{},
+		responses: map[int]int64{},
+	}
+}
+
+func (s *stats) addBytes(host string, n int64) {
+	s.mu.Lock()
+	s.bytes[host] += n
+	s.mu.Unlock()
+}
+
+func (s *stats) addResponse(code int) {
+	s.mu.Lock()
+	s.responses[code]++
+	s.mu.Unlock()
+}
+
+func (s *stats) addRetry() {
+	s.mu.Lock()
+	s.retries++
+	s.mu.Unlock()
+}
+
+// copy of counters, used for metrics
+type Stats struct {
+	BytesByHost map[string]int64
+	Responses   map[int]int64 // by status code, redirects are counted too
+	Retries     int64
+}
+
+func (d *DownloadManager) Stats() Stats {
+	d.stats.mu.Lock()
+	defer d.stats.mu.Unlock()
+
+	return Stats{
+		BytesByHost: maps.Clone(d.stats.bytes),
+		Responses:   maps.Clone(d.stats.responses),
+		Retries:     d.stats.retries,
+	}
+}
+
+// host of download url, it is counted even when download is redirected elsewhere
+// must be called with item locked
+func (d *DownloadItem) host() string {
+	if d.urlHost == "" {
+		d.urlHost = cmp.Or(UrlHost(d.Url), "unknown")
+	}
+	return d.urlHost
+}
@@ -0,0 +1,222 @@
+package downloader
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const stateFilename = "downloads.json"
+
+// saved form of DownloadItem, segments and validators are also in resume state next to part file
+type itemState struct {
+	Id           int64  `json:"id"`
+	Url          string `json:"url"`
+	Filename     string `json:"filename"`
+	Filepath     string `json:"filepath"`
+	State        State  `json:"state"`
+	Downloaded   int64  `json:"downloaded"`
+	Size         int64  `json:"size"`
+	Segments     int    `json:"segments"`
+	PartSuffix   string `json:"partSuffix"`
+	Priority     int    `json:"priority,omitempty"`
+	AutoFilename bool   `json:"autoFilename,omitempty"`
+	RateLimit    int64  `json:"rateLimit,omitempty"`
+	MaxAttempts  int    `json:"maxAttempts,omitempty"`
+
+	// progress of split download, part file has holes and can't be resumed without it
+	Parts        []*segment `json:"parts,omitempty"`
+	ETag         string     `json:"etag,omitempty"`
+	LastModified string     `json:"lastModified,omitempty"`
+
+	Headers http.Header `json:"headers,omitempty"`
+	Auth    *Auth       `json:"auth,omitempty"`
+	Proxy   string      `json:"proxy,omitempty"`
+
+	TLS      *TLSConfig `json:"tls,omitempty"`
+	FinalUrl string     `json:"finalUrl,omitempty"`
+
+	Schedule *Schedule `json:"schedule,omitempty"`
+
+	Transferred int64         `json:"transferred,omitempty"`
+	StartedAt   time.Time     `json:"startedAt,omitzero"`
+	FinishedAt  time.Time     `json:"finishedAt,omitzero"`
+	ActiveTime  time.Duration `json:"activeTime,omitempty"` // nanoseconds
+
+	ChecksumAlgorithm  string `json:"checksumAlgorithm,omitempty"`
+	Checksum           string `json:"checksum,omitempty"`
+	Digest             string `json:"digest,omitempty"`
+	VerificationFailed bool   `json:"verificationFailed,omitempty"`
+
+	Err        string    `json:"err,omitempty"`
+	ErrCode    ErrorKind `json:"errCode,omitempty"`
+	HttpStatus int       `json:"httpStatus,omitempty"`
+}
+
+// whole content of state file
+type managerState struct {
+	NextId    int64       `json:"nextId"`
+	Downloads []itemState `json:"downloads"`
+}
+
+// json file in data dir holding download list between restarts
+type store struct {
+	mu   sync.Mutex
+	path string
+}
+
+func newStore(dataDir string) (*store, error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, err
+	}
+	return &store{path: filepath.Join(dataDir, stateFilename)}, nil
+}
+
+// read saved state, missing file is just empty state
+func (s *store) load() (managerState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var state managerState
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+// write state to temp file and rename it, so crash never leaves half written file
+func (s *store) save(state managerState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// credentials of downloads are saved too, so only owner can read it
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
+
+// snapshot item for saving
+func (d *DownloadItem) getState() itemState {
+	d.Lock()
+	defer d.Unlock()
+
+	errStr := ""
+	var errCode ErrorKind
+	httpStatus := 0
+	if d.Err != nil {
+		downloadErr := classifyError(d.Err)
+		errStr = downloadErr.Error()
+		errCode = downloadErr.Kind
+		httpStatus = downloadErr.StatusCode
+	}
+
+	// copy segments, they are still changing while downloading
+	var parts []*segment
+	for _, s := range d.segments {
+		part := *s
+		parts = append(parts, &part)
+	}
+
+	return itemState{
+		Id:           d.Id,
+		Url:          d.Url,
+		Filename:     d.Filename,
+		Filepath:     d.Filepath,
+		State:        d.State,
+		Downloaded:   d.Downloaded,
+		Size:         d.Size,
+		Segments:     d.Segments,
+		PartSuffix:   d.PartSuffix,
+		Priority:     d.Priority,
+		AutoFilename: d.AutoFilename,
+		RateLimit:    d.limiter.getRate(),
+		MaxAttempts:  d.retry.MaxAttempts,
+
+		Parts:        parts,
+		ETag:         d.ETag,
+		LastModified: d.LastModified,
+
+		Headers: d.Headers,
+		Auth:    d.auth,
+		Proxy:   d.Proxy,
+
+		TLS:      d.TLS,
+		FinalUrl: d.FinalUrl,
+		Schedule: d.Schedule,
+
+		Transferred: d.Transferred,
+		StartedAt:   d.StartedAt,
+		FinishedAt:  d.FinishedAt,
+		ActiveTime:  d.elapsed(),
+
+		ChecksumAlgorithm:  d.ChecksumAlgorithm,
+		Checksum:           d.Checksum,
+		Digest:             d.Digest,
+		VerificationFailed: d.VerificationFailed,
+		Err:                errStr,
+		ErrCode:            errCode,
+		HttpStatus:         httpStatus,
+	}
+}
+
+// create item from saved state
+func newItemFromState(state itemState) *DownloadItem {
+	item := &DownloadItem{
+		Id:           state.Id,
+		Url:          state.Url,
+		Filename:     state.Filename,
+		Filepath:     state.Filepath,
+		State:        state.State,
+		Downloaded:   state.Downloaded,
+		Size:         state.Size,
+		Segments:     state.Segments,
+		PartSuffix:   state.PartSuffix,
+		Priority:     state.Priority,
+		AutoFilename: state.AutoFilename,
+		segments:     state.Parts,
+		ETag:         state.ETag,
+		LastModified: state.LastModified,
+		limiter:      newRateLimiter(state.RateLimit),
+		meter:        newSpeedMeter(),
+		Headers:      state.Headers,
+		auth:         state.Auth,
+		Proxy:        state.Proxy,
+		TLS:          state.TLS,
+		FinalUrl:     state.FinalUrl,
+		Schedule:     state.Schedule,
+		Transferred:  state.Transferred,
+		StartedAt:    state.StartedAt,
+		FinishedAt:   state.FinishedAt,
+		ActiveTime:   state.ActiveTime,
+
+		ChecksumAlgorithm:  state.ChecksumAlgorithm,
+		Checksum:           state.Checksum,
+		Digest:             state.Digest,
+		VerificationFailed: state.VerificationFailed,
+	}
+	if state.Err != "" {
+		item.Err = &DownloadError{
+			Kind:       state.ErrCode,
+			StatusCode: state.HttpStatus,
+			Err:        errors.New(state.Err),
+		}
+	}
+	return item
+}
@@ -0,0 +1,142 @@
+package downloader
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// tls settings of download source, zero value uses system CAs and go defaults
+type TLSConfig struct {
+	CAFiles            []string `json:"caFiles,omitempty"`  // pem files trusted together with system CAs
+	CertFile           string   `json:"certFile,omitempty"` // client certificate for mTLS, pem
+	KeyFile            string   `json:"keyFile,omitempty"`
+	MinVersion         string   `json:"minVersion,omitempty"` // 1.0, 1.1, 1.2 or 1.3
+	InsecureSkipVerify bool     `json:"insecureSkipVerify,omitempty"`
+}
+
+// tls settings for hosts matching pattern
+type TLSRule struct {
+	Pattern string // glob matched against host without port
+	TLS     TLSConfig
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func (c TLSConfig) isZero() bool {
+	return len(c.CAFiles) == 0 && c.CertFile == "" && c.KeyFile == "" && c.MinVersion == "" && !c.InsecureSkipVerify
+}
+
+// load files of config, also used to validate config from user
+func NewTLSConfig(c TLSConfig) (*tls.Config, error) {
+	config := &tls.Config{}
+
+	if c.MinVersion != "" {
+		version, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported TLS version: %s", c.MinVersion)
+		}
+		config.MinVersion = version
+	}
+
+	if len(c.CAFiles) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, caFile := range c.CAFiles {
+			data, err := os.ReadFile(caFile)
+			if err != nil {
+				return nil, fmt.Errorf("could not read CA file: %w", err)
+			}
+			if !pool.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("no certificates found in CA file %s", caFile)
+			}
+		}
+		config.RootCAs = pool
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return nil, fmt.Errorf("client certificate requires both cert and key file")
+		}
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	config.InsecureSkipVerify = c.InsecureSkipVerify
+	return config, nil
+}
+
+// parse rules in form "pattern=option;option, pattern=option", options are
+// ca:file (can be repeated), cert:file, key:file, min:version and insecure
+func ParseTLSRules(rawRules string) ([]TLSRule, error) {
+	var rules []TLSRule
+	for _, rawRule := range strings.Split(rawRules, ",") {
+		if strings.TrimSpace(rawRule) == "" {
+			continue
+		}
+		pattern, rawOptions, found := strings.Cut(rawRule, "=")
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if !found || pattern == "" {
+			return nil, fmt.Errorf("TLS rule must be in form pattern=options, got %q", rawRule)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid TLS rule pattern: %s", pattern)
+		}
+
+		rule := TLSRule{Pattern: pattern}
+		for _, option := range strings.Split(rawOptions, ";") {
+			name, value, _ := strings.Cut(strings.TrimSpace(option), ":")
+			value = strings.TrimSpace(value)
+			switch name {
+			case "ca":
+				rule.TLS.CAFiles = append(rule.TLS.CAFiles, value)
+			case "cert":
+				rule.TLS.CertFile = value
+			case "key":
+				rule.TLS.KeyFile = value
+			case "min":
+				rule.TLS.MinVersion = value
+			case "insecure":
+				rule.TLS.InsecureSkipVerify = true
+			case "":
+			default:
+				return nil, fmt.Errorf("unknown TLS rule option: %s", name)
+			}
+		}
+
+		if _, err := NewTLSConfig(rule.TLS); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// pick tls settings for request, order is download override, host rules, global config
+func (d *DownloadManager) tlsFor(item *DownloadItem, req *http.Request) TLSConfig {
+	if item != nil && item.TLS != nil {
+		return *item.TLS
+	}
+
+	host := strings.ToLower(req.URL.Hostname())
+	for _, rule := range d.config.TLSRules {
+		if matched, _ := path.Match(rule.Pattern, host); matched {
+			return rule.TLS
+		}
+	}
+	return d.config.TLS
+}
@@ -0,0 +1,182 @@
+package downloader
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// settings of connection pool shared by all downloads
+type TransportConfig struct {
+	MaxIdleConns        int           // idle connections kept for all hosts, 0 means no limit
+	MaxIdleConnsPerHost int           // idle connections kept for single host
+	MaxConnsPerHost     int           // all connections to single host, 0 means no limit
+	IdleConnTimeout     time.Duration // idle connection is closed after it, 0 means never
+	KeepAlive           bool          // reuse connections for next requests
+	HTTP2               bool          // segments of download can share single connection
+	MaxRedirects        int           // 0 means redirects are not followed
+}
+
+// key of download in request ctx, so shared transport knows whose request it sends
+type itemCtxKey struct{}
+
+func withItem(ctx context.Context, item *DownloadItem) context.Context {
+	return context.WithValue(ctx, itemCtxKey{}, item)
+}
+
+func itemFromRequest(req *http.Request) *DownloadItem {
+	item, _ := req.Context().Value(itemCtxKey{}).(*DownloadItem)
+	return item
+}
+
+// sends request with transport matching its proxy and tls settings,
+// connections through different proxies or with different client certificates are never shared
+type transportRouter struct {
+	manager    *DownloadManager
+	mu         sync.Mutex
+	transports map[string]*http.Transport // by tls settings and proxy
+}
+
+// settings are picked for every request, so rules match also hosts after redirect
+func (r *transportRouter) RoundTrip(req *http.Request) (*http.Response, error) {
+	proxyUrl, err := r.manager.proxy(req)
+	if err != nil {
+		return nil, err
+	}
+	tlsSettings := r.manager.tlsFor(itemFromRequest(req), req)
+
+	transport, err := r.transport(tlsSettings, proxyUrl, req.URL.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	resp, err := transport.RoundTrip(req)
+	if err == nil {
+		r.manager.stats.addResponse(resp.StatusCode)
+	}
+	return resp, err
+}
+
+// get transport for settings, it is created on first use
+func (r *transportRouter) transport(tlsSettings TLSConfig, proxyUrl *url.URL, host string) (*http.Transport, error) {
+	data, err := json.Marshal(tlsSettings)
+	if err != nil {
+		return nil, err
+	}
+	key := string(data)
+	if proxyUrl != nil {
+		key += " " + proxyUrl.String()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if transport, ok := r.transports[key]; ok {
+		return transport, nil
+	}
+
+	tlsConfig, err := NewTLSConfig(tlsSettings)
+	if err != nil {
+		return nil, err
+	}
+	if tlsSettings.InsecureSkipVerify {
+		slog.Warn("TLS certificate verification is disabled", "host", host)
+	}
+
+	transport := r.manager.newTransport(tlsConfig, proxyUrl)
+	r.transports[key] = transport
+	return transport, nil
+}
+
+// create client used by all downloads, body can take any time, watchdog handles it
+func (d *DownloadManager) newHTTPClient() *http.Client {
+	router := &transportRouter{
+		manager:    d,
+		transports: map[string]*http.Transport{},
+	}
+
+	return &http.Client{
+		Transport:     router,
+		CheckRedirect: d.checkRedirect,
+	}
+}
+
+// create connection pool for one proxy and set of tls settings, nil proxy means direct connection
+func (d *DownloadManager) newTransport(tlsConfig *tls.Config, proxyUrl *url.URL) *http.Transport {
+	config := d.config.Transport
+	timeouts := d.config.Timeouts
+
+	transport := &http.Transport{
+		TLSClientConfig: tlsConfig,
+		Proxy:           http.ProxyURL(proxyUrl),
+		DialContext: (&net.Dialer{
+			Timeout:   timeouts.Dial,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   timeouts.TLSHandshake,
+		ResponseHeaderTimeout: timeouts.ResponseHeader,
+		ExpectContinueTimeout: time.Second,
+
+		MaxIdleConns:        config.MaxIdleConns,
+		MaxIdleConnsPerHost: config.MaxIdleConnsPerHost,
+		MaxConnsPerHost:     config.MaxConnsPerHost,
+		IdleConnTimeout:     config.IdleConnTimeout,
+		DisableKeepAlives:   !config.KeepAlive,
+	}
+
+	transport.Protocols = new(http.Protocols)
+	transport.Protocols.SetHTTP1(true)
+	transport.Protocols.SetHTTP2(config.HTTP2)
+	return transport
+}
+
+// stop following redirects after limit, headers are copied to next request by client
+func (d *DownloadManager) checkRedirect(req *http.Request, via []*http.Request) error {
+	maxRedirects := d.config.Transport.MaxRedirects
+	if maxRedirects <= 0 {
+		// 3xx response is returned and reported as http error
+		return http.ErrUseLastResponse
+	}
+	if len(via) > maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	return nil
+}
+
+// pick proxy for request, remembers which proxy was used by download
+func (d *DownloadManager) proxy(req *http.Request) (*url.URL, error) {
+	item := itemFromRequest(req)
+	if item == nil {
+		return http.ProxyFromEnvironment(req)
+	}
+
+	proxyUrl, err := d.proxyFor(item, req)
+	if err != nil {
+		return nil, err
+	}
+
+	used := ProxyDirect
+	if proxyUrl != nil {
+		used = proxyUrl.Redacted()
+	}
+	item.Lock()
+	item.ProxyUsed = used
+	item.Unlock()
+	return proxyUrl, nil
+}
+
+// remember url after redirects, password is hidden
+func (d *DownloadItem) rememberFinalUrl(resp *http.Response) {
+	if resp.Request == nil {
+		return
+	}
+	d.Lock()
+	d.FinalUrl = resp.Request.URL.Redacted()
+	d.Unlock()
+}
@@ -1,15 +1,87 @@
 package dto
 
+import "time"
+
 // dto to map internal downloaded item to json
 type DownloadItemDto struct {
-	Id         int64  `json:"id"`
-	Url        string `json:"url"`
-	Filename   string `json:"filename"`
-	Filepath   string `json:"filepath"`
-	Active     bool   `json:"active"`
-	Completed  bool   `json:"completed"`
-	Downloaded int64  `json:"downloaded"`
-	Size       int64  `json:"size"`
+	Id       int64  `json:"id"`
+	Url      string `json:"url"`
+	Filename string `json:"filename"`
+	Filepath string `json:"filepath"`
+	// file with data while downloading, empty when completed
+	PartFilepath string `json:"partFilepath"`
+	// paused, queued, scheduled, connecting, downloading, retrying,
+	// verifying, completed, failed or cancelled
+	State string `json:"state"`
+	// flags derived from state, kept for older clients
+	Active     bool  `json:"active"`    // downloading
+	Queued     bool  `json:"queued"`    // waiting for free slot
+	Scheduled  bool  `json:"scheduled"` // waiting for start time or window of schedule
+	Completed  bool  `json:"completed"`
+	Downloaded int64 `json:"downloaded"`
+	Size       int64 `json:"size"`
+	Segments   int   `json:"segments"`
+
+	QueuePosition int `json:"queuePosition"` // 1 is next to start, 0 when not queued
+	Priority      int `json:"priority"`      // higher starts first
+
+	Schedule  *ScheduleDto `json:"schedule"`  // null when download can run any time
+	NextStart *time.Time   `json:"nextStart"` // when scheduled download can start, null when it can run now
+
+	// bytes per second, 0 means no limit
+	RateLimit          int64 `json:"rateLimit"`
+	EffectiveRateLimit int64 `json:"effectiveRateLimit"` // item limit combined with share of global limit
+
+	Attempt   int    `json:"attempt"`   // current attempt, starting with 1
+	Retries   int    `json:"retries"`   // retries since server start
+	AuthType  string `json:"authType"`  // basic, bearer, digest or empty, credentials are never sent
+	Proxy     string `json:"proxy"`     // proxy set for download without password, empty for server setting
+	ProxyUsed string `json:"proxyUsed"` // proxy of last request without password, direct when none
+	FinalUrl  string `json:"finalUrl"`  // url after redirects, empty before first response
+
+	InsecureTLS bool       `json:"insecureTls"` // certificate of server is not verified for this download
+	NextRetry   *time.Time `json:"nextRetry"`   // null when not waiting for retry
 
-	Err string `json:"err"`
+	// bytes per second, speed is average of last few seconds
+	Speed        int64      `json:"speed"`
+	AverageSpeed int64      `json:"averageSpeed"` // over whole active time
+	Eta          *int64     `json:"eta"`          // seconds, null when size or speed is unknown
+	StartedAt    *time.Time `json:"startedAt"`    // first start, null when never started
+	FinishedAt   *time.Time `json:"finishedAt"`
+	Elapsed      int64      `json:"elapsed"` // seconds spent downloading, queue and retry waits not counted
+
+	Checksum           string `json:"checksum"` // expected digest as algorithm:hex
+	Digest             string `json:"digest"`   // computed digest as algorithm:hex
+	VerificationFailed bool   `json:"verificationFailed"`
+
+	Err        string `json:"err"`
+	ErrCode    string `json:"errCode"`    // http_status, network, disk, cancelled, verification or other
+	ErrMsg     string `json:"errMsg"`     // human readable description of error
+	HttpStatus int    `json:"httpStatus"` // status of failed response, 0 if error is not from http
+}
+
+// progress of downloading item, pushed instead of whole item
+type ProgressDto struct {
+	Id           int64  `json:"id"`
+	Downloaded   int64  `json:"downloaded"`
+	Size         int64  `json:"size"`
+	Speed        int64  `json:"speed"`
+	AverageSpeed int64  `json:"averageSpeed"`
+	Eta          *int64 `json:"eta"`
+	Elapsed      int64  `json:"elapsed"`
+}
+
+// totals over all downloads
+type DownloadsSummaryDto struct {
+	Total      int    `json:"total"`
+	Active     int    `json:"active"`
+	Queued     int    `json:"queued"`
+	Scheduled  int    `json:"scheduled"`
+	Retrying   int    `json:"retrying"`
+	Completed  int    `json:"completed"`
+	Failed     int    `json:"failed"`
+	Downloaded int64  `json:"downloaded"`
+	Size       int64  `json:"size"`  // sum of known sizes
+	Speed      int64  `json:"speed"` // bytes per second of all downloads together
+	Eta        *int64 `json:"eta"`   // seconds until unfinished downloads are done
 }
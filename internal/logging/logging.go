@@ -0,0 +1,91 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+type Config struct {
+	Level      slog.Level
+	Format     string // text or json
+	File       string // log is also written to this file, empty means only stderr
+	MaxSize    int64  // bytes, file is rotated when it would grow over it, 0 means no rotation
+	MaxBackups int    // rotated files kept next to log file
+}
+
+// parse level name like debug, info, warn or error
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return level, fmt.Errorf("invalid log level: %q", s)
+	}
+	return level, nil
+}
+
+func ParseFormat(s string) (string, error) {
+	format := strings.ToLower(s)
+	if format != "text" && format != "json" {
+		return "", fmt.Errorf("invalid log format: %q, use text or json", s)
+	}
+	return format, nil
+}
+
+// create logger for config, returned log file is nil when none is set
+func New(config Config) (*slog.Logger, *RotatingFile, error) {
+	var out io.Writer = os.Stderr
+	var file *RotatingFile
+
+	if config.File != "" {
+		var err error
+		file, err = OpenRotatingFile(config.File, config.MaxSize, config.MaxBackups)
+		if err != nil {
+			return nil, nil, err
+		}
+		out = io.MultiWriter(os.Stderr, file)
+	}
+
+	options := &slog.HandlerOptions{Level: config.Level}
+	var handler slog.Handler
+	if config.Format == "json" {
+		handler = slog.NewJSONHandler(out, options)
+	} else {
+		handler = slog.NewTextHandler(out, options)
+	}
+	return slog.New(contextHandler{handler}), file, nil
+}
+
+type requestIdKey struct{}
+
+// remember id of request, every line logged with ctx carries it
+func WithRequestId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIdKey{}, id)
+}
+
+func RequestId(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+// adds values from ctx to records, so handlers do not have to pass them around
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := RequestId(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/matejeliash/medownloader/internal/dto"
+)
+
+const (
+	maxBatchSize = 4 << 20 // max size of request with urls, also of uploaded file
+	maxBatchUrls = 10000   // max number of urls after patterns are expanded
+)
+
+// [001-120], [a-z] or {a,b,c}, brackets without range like ipv6 host are left as they are
+var batchPattern = regexp.MustCompile(`\[(\d+)-(\d+)\]|\[([a-zA-Z])-([a-zA-Z])\]|\{([^{}]*,[^{}]*)\}`)
+
+// single download of batch, error is reported only for its line
+type batchEntry struct {
+	url      string
+	filename string
+	err      error
+}
+
+// read batch from json or multipart form with text file in "file"
+// and json options in "options" field
+func decodeBatch(r *http.Request, data *dto.AddBatchDto) error {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := decodeJson(r, data); err != nil {
+			return fmt.Errorf("invalid batch")
+		}
+		return nil
+	}
+
+	if err := r.ParseMultipartForm(maxBatchSize); err != nil {
+		return fmt.Errorf("invalid form: %w", err)
+	}
+
+	if options := r.FormValue("options"); options != "" {
+		if err := json.Unmarshal([]byte(options), &data.Options); err != nil {
+			return fmt.Errorf("invalid options")
+		}
+	}
+	data.Text = r.FormValue("text")
+
+	file, _, err := r.FormFile("file")
+	if err == http.ErrMissingFile {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read file: %w", err)
+	}
+	defer file.Close()
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return fmt.Errorf("could not read file: %w", err)
+	}
+	data.Text += "\n" + string(content)
+	return nil
+}
+
+// parse lines in form "url" or "url filename", empty lines and lines starting with # are skipped
+func parseBatch(lines []string) ([]batchEntry, error) {
+	var entries []batchEntry
+	for i, line := range lines {
+		// utf-8 BOM from files saved on windows
+		line = strings.TrimSpace(strings.TrimPrefix(line, "\ufeff"))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rawUrl, filename := line, ""
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			rawUrl, filename = line[:i], strings.TrimSpace(line[i+1:])
+		}
+
+		lineEntries := expandEntry(rawUrl, filename, maxBatchUrls-len(entries))
+		if len(entries)+len(lineEntries) > maxBatchUrls {
+			return nil, fmt.Errorf("batch can have at most %d urls, limit reached on line %d", maxBatchUrls, i+1)
+		}
+		entries = append(entries, lineEntries...)
+	}
+	return entries, nil
+}
+
+// expand patterns of single line, filename with the same number
+// of variants is paired with urls, e.g. ep[1-3].mkv "Show E[01-03].mkv"
+func expandEntry(rawUrl, filename string, limit int) []batchEntry {
+	urls, err := expandPattern(rawUrl, limit)
+	if err != nil {
+		return []batchEntry{{url: rawUrl, filename: filename, err: err}}
+	}
+	if filename == "" {
+		entries := make([]batchEntry, len(urls))
+		for i, u := range urls {
+			entries[i] = batchEntry{url: u}
+		}
+		return entries
+	}
+
+	filenames, err := expandPattern(filename, limit)
+	if err == nil && len(urls) > 1 && len(filenames) != len(urls) {
+		err = fmt.Errorf("filename must expand to the same number of names as url (%d)", len(urls))
+	}
+	if err != nil {
+		return []batchEntry{{url: rawUrl, filename: filename, err: err}}
+	}
+	if len(urls) == 1 {
+		// pattern in name of single file is kept, brackets are valid in names
+		return []batchEntry{{url: urls[0], filename: filename}}
+	}
+
+	entries := make([]batchEntry, len(urls))
+	for i, u := range urls {
+		entries[i] = batchEntry{url: u, filename: filenames[i]}
+	}
+	return entries
+}
+
+// expand all patterns in string, variants are combined left to right
+func expandPattern(s string, limit int) ([]string, error) {
+	loc := batchPattern.FindStringIndex(s)
+	if loc == nil {
+		return []string{s}, nil
+	}
+
+	variants, err := patternVariants(s[loc[0]:loc[1]], limit)
+	if err != nil {
+		return nil, err
+	}
+	rest, err := expandPattern(s[loc[1]:], limit)
+	if err != nil {
+		return nil, err
+	}
+	if len(variants)*len(rest) > limit {
+		return nil, fmt.Errorf("pattern expands to more than %d urls", limit)
+	}
+
+	expanded := make([]string, 0, len(variants)*len(rest))
+	for _, variant := range variants {
+		for _, r := range rest {
+			expanded = append(expanded, s[:loc[0]]+variant+r)
+		}
+	}
+	return expanded, nil
+}
+
+// list values of single pattern, numbers keep zero padding of start, e.g. [001-120]
+func patternVariants(pattern string, limit int) ([]string, error) {
+	if strings.HasPrefix(pattern, "{") {
+		return strings.Split(pattern[1:len(pattern)-1], ","), nil
+	}
+
+	rawStart, rawEnd, _ := strings.Cut(pattern[1:len(pattern)-1], "-")
+
+	// letter range
+	if len(rawStart) == 1 && len(rawEnd) == 1 && !isDigit(rawStart[0]) {
+		start, end := rawStart[0], rawEnd[0]
+		if start > end || isUpper(start) != isUpper(end) {
+			return nil, fmt.Errorf("invalid range %s", pattern)
+		}
+		var variants []string
+		for c := start; c <= end; c++ {
+			variants = append(variants, string(c))
+		}
+		return variants, nil
+	}
+
+	start, errStart := strconv.Atoi(rawStart)
+	end, errEnd := strconv.Atoi(rawEnd)
+	if errStart != nil || errEnd != nil || start > end {
+		return nil, fmt.Errorf("invalid range %s", pattern)
+	}
+	if end-start >= limit {
+		return nil, fmt.Errorf("pattern expands to more than %d urls", limit)
+	}
+
+	width := 0
+	if len(rawStart) > 1 && rawStart[0] == '0' {
+		width = len(rawStart)
+	}
+	variants := make([]string, 0, end-start+1)
+	for n := start; n <= end; n++ {
+		variants = append(variants, fmt.Sprintf("%0*d", width, n))
+	}
+	return variants, nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isUpper(c byte) bool {
+	return c >= 'A' && c <= 'Z'
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/matejeliash/medownloader/internal/downloader"
+)
+
+// comment sent when nothing happens, so proxies do not close idle stream
+const eventsPingInterval = 15 * time.Second
+
+// stream changes of downloads as server-sent events, client loads whole list
+// on connect and then applies events, stream ends when client is too slow
+// and browser reconnects on its own
+func (s *Server) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	// typed events repeat state events, web UI does not need them
+	events, unsubscribe := s.downloadManager.Subscribe(
+		downloader.EventAdded,
+		downloader.EventStateChanged,
+		downloader.EventProgress,
+		downloader.EventSummary,
+		downloader.EventDeleted,
+	)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // disable buffering in nginx
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	ping := time.NewTicker(eventsPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := writeEvent(w, event); err != nil {
+				return
+			}
+
+		case <-ping.C:
+			// stream outlives session otherwise, logout or expiry must end it
+			if !s.sessionManger.IsSessionValid(r) {
+				return
+			}
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		}
+
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// write event in SSE format, name of event is its type and data is json
+func writeEvent(w http.ResponseWriter, event downloader.Event) error {
+	var payload any
+	switch event.Type {
+	case downloader.EventProgress:
+		payload = event.Progress
+	case downloader.EventSummary:
+		payload = event.Summary
+	default:
+		payload = event.Item
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+	return err
+}
@@ -1,18 +1,20 @@
 package server
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
+	"github.com/matejeliash/medownloader/internal/downloader"
 	"github.com/matejeliash/medownloader/internal/dto"
 )
 
@@ -47,10 +49,12 @@ func (s *Server) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	decodeJson(r, &data)
 	// compare passwords
 	if data.Password != os.Getenv("ME_PASSWORD") {
+		s.metrics.login(false)
 		encodeErr(w, "incorrect password", http.StatusUnauthorized)
 		return
 	}
 	s.sessionManger.CreateSession(w)
+	s.metrics.login(true)
 
 	resp := dto.MsgResponse{Msg: "ok"}
 
@@ -62,63 +66,250 @@ func (s *Server) AddAndStartDownloadHandler(w http.ResponseWriter, r *http.Reque
 
 	var data dto.AddDownloadDto
 	decodeJson(r, &data)
-	//fmt.Printf("%v\n", data)
 
 	if data.Url == "" || !isUrlValid(data.Url) {
 		encodeErr(w, "url is invalid", http.StatusBadRequest)
 		return
 	}
 
-	// get directory
-	var dir string
-	// user current directory of running program
-	if data.Dir == "" {
+	dir, err := downloadDir(data.Dir)
+	if err != nil {
+		encodeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	filename, autoFilename, err := downloadFilename(data.Url, data.Filename)
+	if err != nil {
+		encodeErr(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	opts, err := downloadOptions(data)
+	if err != nil {
+		encodeErr(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts.AutoFilename = autoFilename
+
+	// manager changes name if it is already taken
+	item := s.downloadManager.AddDownload(data.Url, dir, filename, opts)
+	logger := s.downloadLogger(item.Id)
+	logger.InfoContext(r.Context(), "download added", "filename", item.Filename)
+	if opts.TLS != nil && opts.TLS.InsecureSkipVerify {
+		logger.WarnContext(r.Context(), "TLS certificate verification disabled for download")
+	}
+
+	respData := dto.FileResponse{
+		Id:       item.Id,
+		Filename: item.Filename,
+	}
+
+	if err := s.downloadManager.StartDownload(item); err != nil {
+		encodeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	encodeJson(w, respData, http.StatusAccepted)
+
+}
+
+// add many downloads with the same options, urls come from list,
+// text or uploaded file, patterns like img[001-120].jpg are expanded
+func (s *Server) AddBatchHandler(w http.ResponseWriter, r *http.Request) {
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchSize)
+
+	var data dto.AddBatchDto
+	if err := decodeBatch(r, &data); err != nil {
+		encodeErr(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	lines := append(data.Urls, strings.Split(data.Text, "\n")...)
+	entries, err := parseBatch(lines)
+	if err != nil {
+		encodeErr(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(entries) == 0 {
+		encodeErr(w, "no urls found", http.StatusBadRequest)
+		return
+	}
+
+	// options are checked once, error in them would fail every entry
+	dir, err := downloadDir(data.Options.Dir)
+	if err != nil {
+		encodeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	opts, err := downloadOptions(data.Options)
+	if err != nil {
+		encodeErr(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := dto.BatchResponse{Results: make([]dto.BatchResultDto, 0, len(entries))}
+	var downloads []downloader.NewDownload
+	var added []int // index of result for every download
+	for _, entry := range entries {
+		result := dto.BatchResultDto{Url: entry.url, Filename: entry.filename}
+
+		if entry.err == nil && !isUrlValid(entry.url) {
+			entry.err = fmt.Errorf("url is invalid")
+		}
+		filename, autoFilename, err := downloadFilename(entry.url, entry.filename)
+		if entry.err == nil && err != nil {
+			entry.err = err
+		}
+		if entry.err != nil {
+			result.Err = entry.err.Error()
+			resp.Results = append(resp.Results, result)
+			resp.Failed++
+			continue
+		}
+
+		itemOpts := opts
+		itemOpts.Headers = opts.Headers.Clone()
+		itemOpts.AutoFilename = autoFilename
+
+		downloads = append(downloads, downloader.NewDownload{Url: entry.url, Dir: dir, Filename: filename, Opts: itemOpts})
+		added = append(added, len(resp.Results))
+		resp.Results = append(resp.Results, result)
+	}
+
+	// all at once, saving list after every download would take minutes for big batch
+	items, errs := s.downloadManager.AddDownloads(downloads)
+	for i, item := range items {
+		result := &resp.Results[added[i]]
+		slog.DebugContext(r.Context(), "download added", "download_id", item.Id,
+			"host", downloader.UrlHost(item.Url), "filename", item.Filename)
+		if errs[i] != nil {
+			result.Err = errs[i].Error()
+			resp.Failed++
+			continue
+		}
+
+		id := item.Id
+		result.Id = &id
+		result.Filename = item.Filename
+		resp.Added++
+	}
+
+	if opts.TLS != nil && opts.TLS.InsecureSkipVerify && resp.Added > 0 {
+		slog.WarnContext(r.Context(), "TLS certificate verification disabled for batch", "added", resp.Added)
+	}
+	slog.InfoContext(r.Context(), "batch added", "added", resp.Added, "failed", resp.Failed)
+
+	status := http.StatusAccepted
+	if resp.Added == 0 {
+		status = http.StatusBadRequest
+	}
+	encodeJson(w, resp, status)
+}
+
+// directory for downloads, empty means directory of running program
+func downloadDir(dir string) (string, error) {
+	if dir == "" {
 		wd, err := os.Getwd()
 		if err != nil {
-			encodeErr(w, "could not access directory", http.StatusInternalServerError)
-			return
+			return "", fmt.Errorf("could not access directory")
 		}
-		dir = wd
-		// directory set in form
-	} else {
+		return wd, nil
+	}
 
-		info, err := os.Stat(data.Dir)
-		if err != nil {
-			encodeErr(w, "could not access directory", http.StatusInternalServerError)
-			return
+	info, err := os.Stat(dir)
+	if err != nil {
+		return "", fmt.Errorf("could not access directory")
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("directory is file ")
+	}
+	return dir, nil
+}
+
+// name of file for url, when user sets none, name from url is just a guess
+// and server response can change it later
+func downloadFilename(rawUrl, name string) (string, bool, error) {
+	if name == "" {
+		filename := downloader.FilenameFromUrl(rawUrl)
+		if filename == "" {
+			filename = GetCurTimeStr()
 		}
+		return filename, true, nil
+	}
 
-		if !info.IsDir() {
-			encodeErr(w, "directory is file ", http.StatusInternalServerError)
-			return
+	filename := downloader.SanitizeFilename(name)
+	if filename == "" {
+		return "", false, fmt.Errorf("filename is invalid")
+	}
+	return filename, false, nil
+}
+
+// check settings of download from user, url, dir and filename are checked separately
+func downloadOptions(data dto.AddDownloadDto) (downloader.Options, error) {
+	if data.Checksum != "" {
+		if _, _, err := downloader.ParseChecksum(data.Checksum); err != nil {
+			return downloader.Options{}, err
 		}
 	}
 
-	var filename string
-	if data.Filename == "" {
-		filename = getFilenameFromUrl(data.Url)
-	} else {
-		filename = data.Filename
+	if data.RateLimit < 0 {
+		return downloader.Options{}, fmt.Errorf("rate limit can't be negative")
 	}
 
-	// create final filepath
-	finalPath := filepath.Join(dir, filename)
+	headers, err := downloader.ParseHeaders(data.Headers, data.Cookie)
+	if err != nil {
+		return downloader.Options{}, err
+	}
 
-	if PathExists(finalPath) {
-		filename = GetCurTimeStr() + "-" + filename
-		finalPath = filepath.Join(dir, filename)
+	if data.Proxy != "" {
+		if _, err := downloader.ParseProxy(data.Proxy); err != nil {
+			return downloader.Options{}, err
+		}
 	}
 
-	item := s.downloadManager.AddDownload(data.Url, finalPath, filename)
-	s.downloadManager.StartDownload(item)
+	var tlsConfig *downloader.TLSConfig
+	if data.Tls != nil {
+		tlsConfig = &downloader.TLSConfig{
+			CAFiles:            data.Tls.CaFiles,
+			CertFile:           data.Tls.CertFile,
+			KeyFile:            data.Tls.KeyFile,
+			MinVersion:         data.Tls.MinVersion,
+			InsecureSkipVerify: data.Tls.InsecureSkipVerify,
+		}
+		if _, err := downloader.NewTLSConfig(*tlsConfig); err != nil {
+			return downloader.Options{}, err
+		}
+	}
 
-	respData := dto.FileResponse{
-		Id:       item.Id,
-		Filename: item.Filename,
+	var auth *downloader.Auth
+	if data.Auth != nil {
+		auth, err = downloader.ParseAuth(data.Auth.Type, data.Auth.Username, data.Auth.Password, data.Auth.Token)
+		if err != nil {
+			return downloader.Options{}, err
+		}
 	}
 
-	encodeJson(w, respData, http.StatusAccepted)
+	var schedule *downloader.Schedule
+	if data.Schedule != nil {
+		schedule, err = downloader.ParseSchedule(data.Schedule.StartAt, data.Schedule.Windows)
+		if err != nil {
+			return downloader.Options{}, err
+		}
+	}
 
+	return downloader.Options{
+		Segments:    data.Segments,
+		RateLimit:   data.RateLimit,
+		MaxAttempts: data.Retries,
+		Checksum:    data.Checksum,
+		Headers:     headers,
+		Auth:        auth,
+		Proxy:       strings.TrimSpace(data.Proxy),
+		TLS:         tlsConfig,
+		Schedule:    schedule,
+		Priority:    data.Priority,
+	}, nil
 }
 
 func (s *Server) GetAllDownloadsHandler(w http.ResponseWriter, r *http.Request) {
@@ -128,6 +319,14 @@ func (s *Server) GetAllDownloadsHandler(w http.ResponseWriter, r *http.Request)
 
 }
 
+// totals over all downloads, kept apart so /downloads stays plain list
+func (s *Server) GetSummaryHandler(w http.ResponseWriter, r *http.Request) {
+
+	summary := s.downloadManager.Summary(s.downloadManager.GetAllDownloads())
+	encodeJson(w, summary, http.StatusOK)
+
+}
+
 // get current dir into {path, freespace}
 func (s *Server) GetCurDirInfoHandler(w http.ResponseWriter, r *http.Request) {
 	info := getCurDirInfo()
@@ -147,24 +346,180 @@ func (s *Server) ToggleHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	item := s.downloadManager.GetItemById(int64(id))
-	if item == nil {
-		encodeErr(w, fmt.Sprintf("downloadItem with id:%s not found", idStr), http.StatusInternalServerError)
+	// manager decides between stop and resume, so state can't change in between
+	state, err := s.downloadManager.ToggleDownload(int64(id))
+	if errors.Is(err, downloader.ErrInvalidTransition) {
+		encodeErr(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		encodeErr(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	s.downloadLogger(int64(id)).InfoContext(r.Context(), "download toggled", "state", state)
+
+	encodeJson(w, dto.MsgResponse{Msg: string(state)}, http.StatusOK)
+}
+
+// get max number of running downloads
+func (s *Server) GetQueueHandler(w http.ResponseWriter, r *http.Request) {
+	resp := dto.QueueDto{MaxActive: s.downloadManager.MaxActive()}
+	encodeJson(w, resp, http.StatusOK)
+}
+
+// change max number of running downloads, queued items start right away if limit grows
+func (s *Server) SetQueueHandler(w http.ResponseWriter, r *http.Request) {
+	var data dto.QueueDto
+	if err := decodeJson(r, &data); err != nil {
+		encodeErr(w, "invalid queue settings", http.StatusBadRequest)
+		return
+	}
+
+	if data.MaxActive < 0 {
+		encodeErr(w, "max active downloads can't be negative", http.StatusBadRequest)
+		return
+	}
+
+	s.downloadManager.SetMaxActive(data.MaxActive)
+	slog.InfoContext(r.Context(), "max active downloads changed", "max_active", data.MaxActive)
+
+	encodeJson(w, data, http.StatusOK)
+}
+
+// get global bandwidth limit
+func (s *Server) GetRateLimitHandler(w http.ResponseWriter, r *http.Request) {
+	resp := dto.RateLimitDto{Limit: s.downloadManager.RateLimit()}
+	encodeJson(w, resp, http.StatusOK)
+}
+
+// change global bandwidth limit without restarting downloads
+func (s *Server) SetRateLimitHandler(w http.ResponseWriter, r *http.Request) {
+	var data dto.RateLimitDto
+	if err := decodeJson(r, &data); err != nil || data.Limit < 0 {
+		encodeErr(w, "invalid rate limit", http.StatusBadRequest)
 		return
+	}
+
+	s.downloadManager.SetRateLimit(data.Limit)
+	slog.InfoContext(r.Context(), "global rate limit changed", "limit", data.Limit)
+
+	encodeJson(w, data, http.StatusOK)
+}
 
+// change bandwidth limit of single download
+func (s *Server) SetItemRateLimitHandler(w http.ResponseWriter, r *http.Request) {
+	idStr := r.PathValue("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		encodeErr(w, fmt.Sprintf("wrong id: %s", idStr), http.StatusBadRequest)
+		return
 	}
 
-	// decoding id stop download or resume
-	if item.Active {
-		s.downloadManager.StopDownload(item)
-		log.Println("stopped download ", id)
+	var data dto.RateLimitDto
+	if err := decodeJson(r, &data); err != nil || data.Limit < 0 {
+		encodeErr(w, "invalid rate limit", http.StatusBadRequest)
+		return
 	}
 
-	if !item.Active && !item.Completed {
-		s.downloadManager.ResumeDownload(int64(id))
-		log.Println("resumed download ", id)
+	if err := s.downloadManager.SetItemRateLimit(int64(id), data.Limit); err != nil {
+		encodeErr(w, err.Error(), http.StatusNotFound)
+		return
 	}
+	s.downloadLogger(int64(id)).InfoContext(r.Context(), "rate limit changed", "limit", data.Limit)
 
+	encodeJson(w, data, http.StatusOK)
+}
+
+// change priority of download, it moves behind items with the same priority
+func (s *Server) SetPriorityHandler(w http.ResponseWriter, r *http.Request) {
+	idStr := r.PathValue("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		encodeErr(w, fmt.Sprintf("wrong id: %s", idStr), http.StatusBadRequest)
+		return
+	}
+
+	var data dto.PriorityDto
+	if err := decodeJson(r, &data); err != nil {
+		encodeErr(w, "invalid priority", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.downloadManager.SetItemPriority(int64(id), data.Priority); err != nil {
+		encodeErr(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	s.downloadLogger(int64(id)).InfoContext(r.Context(), "priority changed", "priority", data.Priority)
+
+	encodeJson(w, data, http.StatusOK)
+}
+
+// move download to top, bottom or position in queue
+func (s *Server) MoveHandler(w http.ResponseWriter, r *http.Request) {
+	idStr := r.PathValue("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		encodeErr(w, fmt.Sprintf("wrong id: %s", idStr), http.StatusBadRequest)
+		return
+	}
+
+	var data dto.PositionDto
+	switch r.PathValue("where") {
+	case "top":
+		data.Position = 1
+	case "bottom":
+		// manager moves position out of range to the end
+		data.Position = math.MaxInt
+	case "position":
+		if err := decodeJson(r, &data); err != nil || data.Position < 1 {
+			encodeErr(w, "invalid position", http.StatusBadRequest)
+			return
+		}
+	default:
+		encodeErr(w, "item can be moved to top, bottom or position", http.StatusNotFound)
+		return
+	}
+
+	if err := s.downloadManager.MoveDownload(int64(id), data.Position); err != nil {
+		encodeErr(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	s.downloadLogger(int64(id)).InfoContext(r.Context(), "download moved", "where", r.PathValue("where"))
+
+	encodeJson(w, dto.MsgResponse{Msg: "moved"}, http.StatusOK)
+}
+
+// change when download can run, null or empty schedule lets it run any time
+func (s *Server) SetScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	idStr := r.PathValue("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		encodeErr(w, fmt.Sprintf("wrong id: %s", idStr), http.StatusBadRequest)
+		return
+	}
+
+	var data *dto.ScheduleDto
+	if err := decodeJson(r, &data); err != nil {
+		encodeErr(w, "invalid schedule", http.StatusBadRequest)
+		return
+	}
+
+	var schedule *downloader.Schedule
+	if data != nil {
+		schedule, err = downloader.ParseSchedule(data.StartAt, data.Windows)
+		if err != nil {
+			encodeErr(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := s.downloadManager.SetItemSchedule(int64(id), schedule); err != nil {
+		encodeErr(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	s.downloadLogger(int64(id)).InfoContext(r.Context(), "schedule changed")
+
+	encodeJson(w, data, http.StatusOK)
 }
 
 // delete download with proper http client and goroutine cancellation
@@ -187,21 +542,6 @@ func (s *Server) DeleteHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
-// get filename from url, e.g. http://...../123.txt -> 123.txt
-func getFilenameFromUrl(url string) string {
-
-	urlParts := strings.Split(url, "/")
-	if len(urlParts) > 0 {
-		return urlParts[len(urlParts)-1]
-	} else {
-
-		now := time.Now()
-		// Layout string: 2006 = Year, 01 = Month, 02 = Day, 15 = Hour (24h), 04 = Minute, 05 = Second
-		formatted := now.Format("2006-01-02-15-04-05")
-		return formatted
-	}
-}
-
 // find if resource is http
 func isUrlValid(urlStr string) bool {
 	// split URL into parts
@@ -276,3 +616,12 @@ func getCurDirInfo() dto.CurDirInfo {
 
 	return info
 }
+
+// logger with id and host of download, request id is added from ctx
+func (s *Server) downloadLogger(id int64) *slog.Logger {
+	host := ""
+	if item := s.downloadManager.GetItemById(id); item != nil {
+		host = downloader.UrlHost(item.Url)
+	}
+	return slog.With("download_id", id, "host", host)
+}
@@ -0,0 +1,268 @@
+package server
+
+import (
+	"cmp"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matejeliash/medownloader/internal/downloader"
+)
+
+// upper bounds of api latency histogram in seconds
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type MetricsConfig struct {
+	Enabled bool
+	Token   string // bearer token required by /metrics, empty means no auth
+}
+
+type histogram struct {
+	counts []int64 // by bucket, not cumulative
+	count  int64
+	sum    float64
+}
+
+func (h *histogram) observe(seconds float64) {
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+type requestKey struct {
+	route string
+	code  int
+}
+
+// counters of api, they are not saved
+type metrics struct {
+	mu            sync.Mutex
+	latency       map[string]*histogram // by route
+	requests      map[requestKey]int64
+	logins        int64
+	loginFailures int64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		latency:  map[string]*histogram{},
+		requests: map[requestKey]int64{},
+	}
+}
+
+func (m *metrics) observe(route string, code int, duration time.Duration, latency bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[requestKey{route, code}]++
+	if !latency {
+		return
+	}
+	h, ok := m.latency[route]
+	if !ok {
+		h = &histogram{counts: make([]int64, len(latencyBuckets))}
+		m.latency[route] = h
+	}
+	h.observe(duration.Seconds())
+}
+
+func (m *metrics) login(success bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if success {
+		m.logins++
+	} else {
+		m.loginFailures++
+	}
+}
+
+// measure latency and count responses of all endpoints by route
+func (s *Server) middlewareMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		route := s.route(r)
+		// stream is open while page is, its duration is not latency
+		latency := route != "GET /api/events"
+		s.metrics.observe(route, sw.status, time.Since(start), latency)
+	})
+}
+
+// pattern which matched request, ids in path would create too many series,
+// must be called after request was served, so main mux has set pattern
+func (s *Server) route(r *http.Request) string {
+	if r.Pattern == "" {
+		return "unmatched"
+	}
+	if r.Pattern != "/api/" {
+		return r.Pattern
+	}
+
+	// find pattern of api mux the same way as prefix is stripped
+	inner := *r
+	innerUrl := *r.URL
+	innerUrl.Path = strings.TrimPrefix(r.URL.Path, "/api")
+	inner.URL = &innerUrl
+	_, pattern := s.apiMux.Handler(&inner)
+
+	method, path, found := strings.Cut(pattern, " ")
+	if pattern == "" || !found {
+		return "/api/"
+	}
+	return method + " /api" + path
+}
+
+// metrics are open without token, otherwise token or valid session is needed
+func (s *Server) metricsAllowed(r *http.Request) bool {
+	if s.metricsToken == "" || s.sessionManger.IsSessionValid(r) {
+		return true
+	}
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return found && subtle.ConstantTimeCompare([]byte(token), []byte(s.metricsToken)) == 1
+}
+
+// write metrics in prometheus text format
+func (s *Server) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.metricsAllowed(r) {
+		encodeErr(w, "metrics token not valid / not provided", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	s.writeDownloadMetrics(w)
+	s.writeApiMetrics(w)
+}
+
+func (s *Server) writeDownloadMetrics(w io.Writer) {
+	stats := s.downloadManager.Stats()
+	downloads := s.downloadManager.GetAllDownloads()
+	summary := s.downloadManager.Summary(downloads)
+
+	var total int64
+	for _, n := range stats.BytesByHost {
+		total += n
+	}
+	writeHeader(w, "medownloader_downloaded_bytes_total", "counter", "Bytes received from download servers since start.")
+	writeSample(w, "medownloader_downloaded_bytes_total", nil, total)
+
+	writeHeader(w, "medownloader_host_downloaded_bytes_total", "counter", "Bytes received since start by host of download url.")
+	for _, host := range slices.Sorted(maps.Keys(stats.BytesByHost)) {
+		writeSample(w, "medownloader_host_downloaded_bytes_total", []string{"host", host}, stats.BytesByHost[host])
+	}
+
+	states := map[string]int{}
+	for _, item := range downloads {
+		states[item.State]++
+	}
+	writeHeader(w, "medownloader_downloads", "gauge", "Downloads by state.")
+	for _, state := range downloader.States {
+		writeSample(w, "medownloader_downloads", []string{"state", string(state)}, states[string(state)])
+	}
+
+	writeHeader(w, "medownloader_speed_bytes", "gauge", "Current speed of all downloads in bytes per second.")
+	writeSample(w, "medownloader_speed_bytes", nil, summary.Speed)
+
+	writeHeader(w, "medownloader_download_speed_bytes", "gauge", "Current speed of download in bytes per second.")
+	for _, item := range downloads {
+		writeSample(w, "medownloader_download_speed_bytes", itemLabels(item.Id, item.Filename, item.Url), item.Speed)
+	}
+
+	writeHeader(w, "medownloader_download_retries", "gauge", "Retries of download since start.")
+	for _, item := range downloads {
+		writeSample(w, "medownloader_download_retries", itemLabels(item.Id, item.Filename, item.Url), item.Retries)
+	}
+
+	writeHeader(w, "medownloader_retries_total", "counter", "Retries of all downloads since start.")
+	writeSample(w, "medownloader_retries_total", nil, stats.Retries)
+
+	writeHeader(w, "medownloader_http_responses_total", "counter", "Responses of download servers by status code.")
+	for _, code := range slices.Sorted(maps.Keys(stats.Responses)) {
+		writeSample(w, "medownloader_http_responses_total", []string{"code", strconv.Itoa(code)}, stats.Responses[code])
+	}
+}
+
+func (s *Server) writeApiMetrics(w io.Writer) {
+	writeHeader(w, "medownloader_sessions", "gauge", "Valid sessions of web UI.")
+	writeSample(w, "medownloader_sessions", nil, s.sessionManger.Count())
+
+	s.metrics.mu.Lock()
+	defer s.metrics.mu.Unlock()
+
+	writeHeader(w, "medownloader_logins_total", "counter", "Successful logins since start.")
+	writeSample(w, "medownloader_logins_total", nil, s.metrics.logins)
+
+	writeHeader(w, "medownloader_login_failures_total", "counter", "Logins with wrong password since start.")
+	writeSample(w, "medownloader_login_failures_total", nil, s.metrics.loginFailures)
+
+	// sorted, so output does not jump around
+	keys := slices.SortedFunc(maps.Keys(s.metrics.requests), func(a, b requestKey) int {
+		return cmp.Or(strings.Compare(a.route, b.route), cmp.Compare(a.code, b.code))
+	})
+	writeHeader(w, "medownloader_api_requests_total", "counter", "Requests of web UI and api by route and status code.")
+	for _, key := range keys {
+		writeSample(w, "medownloader_api_requests_total", []string{"route", key.route, "code", strconv.Itoa(key.code)}, s.metrics.requests[key])
+	}
+
+	writeHeader(w, "medownloader_api_request_duration_seconds", "histogram", "Latency of web UI and api requests by route.")
+	for _, route := range slices.Sorted(maps.Keys(s.metrics.latency)) {
+		h := s.metrics.latency[route]
+		var cumulative int64
+		for i, bound := range latencyBuckets {
+			cumulative += h.counts[i]
+			le := strconv.FormatFloat(bound, 'g', -1, 64)
+			writeSample(w, "medownloader_api_request_duration_seconds_bucket", []string{"route", route, "le", le}, cumulative)
+		}
+		writeSample(w, "medownloader_api_request_duration_seconds_bucket", []string{"route", route, "le", "+Inf"}, h.count)
+		writeSample(w, "medownloader_api_request_duration_seconds_sum", []string{"route", route}, h.sum)
+		writeSample(w, "medownloader_api_request_duration_seconds_count", []string{"route", route}, h.count)
+	}
+}
+
+func itemLabels(id int64, filename, rawUrl string) []string {
+	return []string{"id", strconv.FormatInt(id, 10), "filename", filename, "host", downloader.UrlHost(rawUrl)}
+}
+
+func writeHeader(w io.Writer, name, metricType, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// labels are pairs of name and value
+func writeSample(w io.Writer, name string, labels []string, value any) {
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteString("{")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			fmt.Fprintf(&b, "%s=\"%s\"", labels[i], escapeLabel(labels[i+1]))
+		}
+		b.WriteString("}")
+	}
+	fmt.Fprintf(w, "%s %v\n", b.String(), value)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
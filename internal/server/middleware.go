@@ -1,21 +1,47 @@
 package server
 
 import (
-	"log"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
 	"net/http"
+	"time"
+
+	"github.com/matejeliash/medownloader/internal/logging"
 )
 
 // we  use http.Handler interface  so we can use middleware on ServeMux
 // with little modification we can use http.HandleFunc so we can easily use middleware on single handler
 
+// give every request id, so all its log lines can be found, and log it when it is done,
+// id sent by proxy in X-Request-Id is used when present
 func middlewareLog(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// just simple log before handling actual request
-		log.Printf("-> %s %s", r.Method, r.URL.Path)
-		next.ServeHTTP(w, r)
+		id := r.Header.Get("X-Request-Id")
+		if id == "" || len(id) > 64 {
+			id = newRequestId()
+		}
+		w.Header().Set("X-Request-Id", id)
+		r = r.WithContext(logging.WithRequestId(r.Context(), id))
+
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		slog.InfoContext(r.Context(), "request", "method", r.Method, "path", r.URL.Path,
+			"status", sw.status, "duration", time.Since(start))
 	})
 }
 
+func newRequestId() string {
+	randomBytes := make([]byte, 8)
+	rand.Read(randomBytes)
+	return hex.EncodeToString(randomBytes)
+}
+
 // checking token and it's expiration date from cookie
 func (s *Server) middlewareAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -31,7 +57,7 @@ func (s *Server) middlewareAuth(next http.Handler) http.Handler {
 			})
 
 			encodeErr(w, "session token not valid / not provided", http.StatusUnauthorized)
-			log.Printf("-> %s %s [STOPPED]", r.Method, r.URL.Path)
+			slog.DebugContext(r.Context(), "request stopped, session not valid", "path", r.URL.Path)
 			return
 		}
 		next.ServeHTTP(w, r)
@@ -39,3 +65,28 @@ func (s *Server) middlewareAuth(next http.Handler) http.Handler {
 	})
 
 }
+
+// remembers status code, so middleware can count responses
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// used by http.ResponseController, so events can be flushed
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
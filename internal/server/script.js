@@ -1,6 +1,3 @@
-// hold downloads from previous fetch
-let prevDownloads = [];
-
 // send request to stop / resume download
 async function toggleDownload(id) {
   try {
@@ -19,6 +16,60 @@ async function toggleDownload(id) {
   }
 }
 
+// move download to top, bottom or position in queue, body is used only for position
+async function moveDownload(id, where, body) {
+  try {
+    const resp = await fetch(`/api/queue/${id}/${where}`, {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify(body || {}),
+      credentials: "include",
+    });
+
+    if (resp.ok) {
+      getDownloadsAndFillTable();
+    } else {
+      alert((await resp.json()).err);
+    }
+  } catch (err) {
+    console.error("Fetch failed:", err);
+  }
+}
+
+// change priority and optionally position of download from form
+async function setPriority() {
+  const id = parseInt(document.getElementById("priorityId").value);
+  if (isNaN(id)) {
+    alert("download id is required");
+    return;
+  }
+
+  try {
+    const resp = await fetch(`/api/priority/${id}`, {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({
+        priority: parseInt(document.getElementById("priority").value) || 0,
+      }),
+      credentials: "include",
+    });
+
+    if (!resp.ok) {
+      alert((await resp.json()).err);
+      return;
+    }
+  } catch (err) {
+    console.error("Fetch failed:", err);
+  }
+
+  const position = parseInt(document.getElementById("position").value);
+  if (!isNaN(position)) {
+    moveDownload(id, "position", { position: position });
+  } else {
+    getDownloadsAndFillTable();
+  }
+}
+
 //send request to delete download
 async function deleteDownload(id) {
   try {
@@ -50,6 +101,32 @@ function formatBytes(bytes) {
   }
 }
 
+// format seconds to e.g. 1h 02m 05s
+function formatDuration(seconds) {
+  const h = Math.floor(seconds / 3600);
+  const m = Math.floor((seconds % 3600) / 60);
+  const s = seconds % 60;
+  const pad = (n) => String(n).padStart(2, "0");
+  if (h > 0) {
+    return `${h}h ${pad(m)}m ${pad(s)}s`;
+  } else if (m > 0) {
+    return `${m}m ${pad(s)}s`;
+  }
+  return `${s}s`;
+}
+
+// show totals of all downloads above table
+function fillSummary(summary) {
+  let text =
+    `${summary.active} active, ${summary.queued} queued, ` +
+    `${summary.completed} finished, ${summary.failed} failed, ` +
+    `${formatBytes(summary.speed)}/s`;
+  if (summary.eta !== null) {
+    text += `, ${formatDuration(summary.eta)} left`;
+  }
+  document.getElementById("summary").textContent = text;
+}
+
 // fill table with data
 function fillTable(downloads) {
   // disable table if no items in DB
@@ -63,73 +140,126 @@ function fillTable(downloads) {
   console.log(downloads);
   const tbody = document.getElementById("table-body");
 
-  downloads.forEach((d) => {
-    const rowId = `row${d.id}`;
-    let row = document.getElementById(rowId);
-
-    // row is not present create
-    if (!row) {
-      row = document.createElement("tr");
-      row.id = rowId;
-
-      for (let i = 0; i < 8; i++) {
-        const td = document.createElement("td");
-        row.appendChild(td);
-      }
-
-      row.cells[5].textContent = "0 MB/s";
+  // rows of downloads deleted elsewhere are removed
+  const ids = new Set(downloads.map((d) => `row${d.id}`));
+  Array.from(tbody.rows).forEach((row) => {
+    if (!ids.has(row.id)) {
+      row.remove();
+    }
+  });
 
-      toggleBtn = document.createElement("button");
-      toggleBtn.textContent = "Toggle";
-      toggleBtn.classList.add("buttonBlue");
-      toggleBtn.addEventListener("click", () => {
-        toggleDownload(d.id);
-      });
+  downloads.forEach((d) => {
+    // rows follow queue order, appending existing row just moves it
+    tbody.appendChild(fillRow(d));
+  });
+}
 
-      deleteBtn = document.createElement("button");
-      deleteBtn.textContent = "Delete";
-      deleteBtn.classList.add("buttonRed");
-      deleteBtn.addEventListener("click", () => {
-        if (deleteDownload(d.id)) {
-          row.remove();
-        }
-      });
+// create or update row of single download, new row is added to end of table
+function fillRow(d) {
+  const tbody = document.getElementById("table-body");
+  const rowId = `row${d.id}`;
+  let row = document.getElementById(rowId);
 
-      row.cells[6].appendChild(toggleBtn);
-      row.cells[7].appendChild(deleteBtn);
+  // row is not present create
+  if (!row) {
+    row = document.createElement("tr");
+    row.id = rowId;
 
-      row.cells[0].textContent = d.id;
-      row.cells[2].textContent = d.filename;
-      row.cells[3].textContent = `0.0 GB`;
+    for (let i = 0; i < 9; i++) {
+      const td = document.createElement("td");
+      row.appendChild(td);
+    }
 
-      tbody.appendChild(row);
+    toggleBtn = document.createElement("button");
+    toggleBtn.textContent = "Toggle";
+    toggleBtn.classList.add("buttonBlue");
+    toggleBtn.addEventListener("click", () => {
+      toggleDownload(d.id);
+    });
 
-      // row is present just change calculated data
-    } else {
-      const prevDownload = prevDownloads.find(
-        (download) => download.id === d.id,
-      );
+    deleteBtn = document.createElement("button");
+    deleteBtn.textContent = "Delete";
+    deleteBtn.classList.add("buttonRed");
+    deleteBtn.addEventListener("click", () => {
+      if (deleteDownload(d.id)) {
+        row.remove();
+      }
+    });
 
-      row.cells[5].textContent =
-        formatBytes((d.downloaded - prevDownload.downloaded) / 2) + "/s";
-    }
+    // move to start or end of queue
+    topBtn = document.createElement("button");
+    topBtn.textContent = "Top";
+    topBtn.classList.add("buttonBlue");
+    topBtn.addEventListener("click", () => moveDownload(d.id, "top"));
+
+    bottomBtn = document.createElement("button");
+    bottomBtn.textContent = "Bottom";
+    bottomBtn.classList.add("buttonBlue");
+    bottomBtn.addEventListener("click", () => moveDownload(d.id, "bottom"));
+
+    row.cells[7].appendChild(toggleBtn);
+    row.cells[7].appendChild(topBtn);
+    row.cells[7].appendChild(bottomBtn);
+    row.cells[8].appendChild(deleteBtn);
+
+    row.cells[0].textContent = d.id;
+    row.cells[2].textContent = d.filename;
+    row.cells[3].textContent = `0.0 GB`;
+    tbody.appendChild(row);
+  }
+  row.cells[0].title = "priority " + d.priority;
+
+  let status = d.state;
+  row.cells[1].title = "";
+  if (d.state === "queued") {
+    // items from events have no position, it comes with next reload
+    status = d.queuePosition ? `queued #${d.queuePosition}` : "queued";
+  } else if (d.state === "scheduled" && d.nextStart) {
+    status = "scheduled for " + new Date(d.nextStart).toLocaleString();
+  } else if (d.state === "retrying") {
+    status = `retrying (attempt ${d.attempt}): ${d.errMsg}`;
+  } else if (d.state === "completed") {
+    status = "finished";
+  } else if (d.verificationFailed) {
+    status = "verification failed";
+  } else if (d.state === "failed") {
+    status = d.errMsg;
+    row.cells[1].title = d.err;
+  }
 
-    let status;
-    if (d.active) {
-      status = "active";
-    } else if (d.completed) {
-      status = "finished";
-    } else if (!d.active && !d.completed && d.err === "") {
-      status = "stopped";
-    } else {
-      status = d.err;
-    }
+  row.cells[1].textContent = status;
+  // where file really comes from, shown on hover
+  row.cells[2].title = [
+    d.finalUrl || d.url,
+    d.proxyUsed ? "proxy: " + d.proxyUsed : "",
+  ].join("\n");
+  row.cells[3].textContent = formatBytes(d.downloaded);
+  row.cells[4].textContent = formatBytes(d.size);
+
+  // finished download shows its average speed and time it took
+  if (d.state === "downloading") {
+    row.cells[5].textContent = formatBytes(d.speed) + "/s";
+    row.cells[6].textContent = d.eta !== null ? formatDuration(d.eta) : "?";
+  } else if (d.state === "completed") {
+    row.cells[5].textContent = formatBytes(d.averageSpeed) + "/s avg";
+    row.cells[6].textContent = "took " + formatDuration(d.elapsed);
+  } else {
+    row.cells[5].textContent = "";
+    row.cells[6].textContent = "";
+  }
+  return row;
+}
 
-    row.cells[1].textContent = status;
-    row.cells[3].textContent = formatBytes(d.downloaded);
-    row.cells[4].textContent = formatBytes(d.size);
-  });
-  prevDownloads = downloads;
+// update transfer cells of downloading item from progress event
+function fillProgress(p) {
+  const row = document.getElementById(`row${p.id}`);
+  if (!row) {
+    return;
+  }
+  row.cells[3].textContent = formatBytes(p.downloaded);
+  row.cells[4].textContent = formatBytes(p.size);
+  row.cells[5].textContent = formatBytes(p.speed) + "/s";
+  row.cells[6].textContent = p.eta !== null ? formatDuration(p.eta) : "?";
 }
 
 // get free space and name of current dir
@@ -165,6 +295,11 @@ async function logout() {
     if (resp.ok) {
       document.getElementById("appArea").style.display = "none";
       document.getElementById("loginArea").style.display = "block";
+      if (eventSource) {
+        eventSource.close();
+        eventSource = null;
+      }
+      stopPolling();
     } else {
     }
   } catch (err) {
@@ -175,10 +310,10 @@ async function logout() {
 // fetch all downloads and also call filltable
 async function getDownloadsAndFillTable() {
   try {
-    const resp = await fetch("/api/downloads", {
-      method: "GET",
-      credentials: "include",
-    });
+    const [resp, summaryResp] = await Promise.all([
+      fetch("/api/downloads", { method: "GET", credentials: "include" }),
+      fetch("/api/summary", { method: "GET", credentials: "include" }),
+    ]);
 
     if (resp.ok) {
       const downloads = await resp.json();
@@ -186,15 +321,79 @@ async function getDownloadsAndFillTable() {
     } else {
       console.log(await resp.json());
     }
+    if (summaryResp.ok) {
+      fillSummary(await summaryResp.json());
+    }
   } catch (err) {
     console.error("Fetch failed:", err);
   }
 }
 
+// parse lines in form Name: value into object
+function parseHeaders(text) {
+  const headers = {};
+  text.split("\n").forEach((line) => {
+    const i = line.indexOf(":");
+    if (i > 0) {
+      headers[line.slice(0, i).trim()] = line.slice(i + 1).trim();
+    }
+  });
+  return headers;
+}
+
+// credentials from form, null when not needed
+function getAuth() {
+  const type = document.getElementById("authType").value;
+  if (!type) {
+    return null;
+  }
+  return {
+    type: type,
+    username: document.getElementById("authUsername").value,
+    password: document.getElementById("authPassword").value,
+    token: document.getElementById("authToken").value.trim(),
+  };
+}
+
+// read start time and windows, null when download should start right away
+function getSchedule(startAtId, windowsId) {
+  const startAt = document.getElementById(startAtId).value;
+  const windows = document
+    .getElementById(windowsId)
+    .value.split(";")
+    .map((w) => w.trim())
+    .filter((w) => w);
+  if (!startAt && windows.length === 0) {
+    return null;
+  }
+  return {
+    // datetime-local input has no zone, browser converts it from local time
+    startAt: startAt ? new Date(startAt).toISOString() : null,
+    windows: windows,
+  };
+}
+
+// settings from form shared by single and bulk add
+function downloadOptions() {
+  return {
+    dir: document.getElementById("dir").value.trim(),
+    // 0 lets server use its default
+    segments: parseInt(document.getElementById("segments").value) || 0,
+    checksum: document.getElementById("checksum").value.trim(),
+    rateLimit: (parseInt(document.getElementById("rateLimit").value) || 0) * 1000,
+    headers: parseHeaders(document.getElementById("headers").value),
+    cookie: document.getElementById("cookie").value.trim(),
+    auth: getAuth(),
+    proxy: document.getElementById("proxy").value.trim(),
+    schedule: getSchedule("startAt", "windows"),
+    priority: parseInt(document.getElementById("addPriority").value) || 0,
+  };
+}
+
 async function startDownload() {
   const data = {
+    ...downloadOptions(),
     url: document.getElementById("url").value.trim(),
-    dir: document.getElementById("dir").value.trim(),
     filename: document.getElementById("filename").value.trim(),
   };
 
@@ -225,6 +424,149 @@ async function startDownload() {
   }
 }
 
+// add all urls from bulk textarea and selected text file with settings from form
+async function startBatch() {
+  const form = new FormData();
+  form.append("options", JSON.stringify(downloadOptions()));
+  form.append("text", document.getElementById("bulkUrls").value);
+  const file = document.getElementById("bulkFile").files[0];
+  if (file) {
+    form.append("file", file);
+  }
+
+  try {
+    const resp = await fetch("/api/add/batch", {
+      method: "POST",
+      body: form,
+      credentials: "include",
+    });
+
+    const respData = await resp.json();
+    const info = document.getElementById("downloadInfo");
+    if (respData.results) {
+      const errors = respData.results
+        .filter((result) => result.err)
+        .map((result) => result.url + ": " + result.err);
+      info.textContent =
+        "added " + respData.added + " downloads, " + respData.failed + " failed";
+      info.title = errors.join("\n");
+    } else {
+      info.textContent = respData.err;
+    }
+  } catch (err) {
+    console.error("Fetch failed:", err);
+  }
+}
+
+// load max number of running downloads into input
+async function getQueue() {
+  try {
+    const resp = await fetch("/api/queue", {
+      method: "GET",
+      credentials: "include",
+    });
+
+    if (resp.ok) {
+      const queue = await resp.json();
+      document.getElementById("maxActive").value = queue.maxActive;
+    } else {
+      console.log(await resp.json());
+    }
+  } catch (err) {
+    console.error("Fetch failed:", err);
+  }
+}
+
+// change max number of running downloads
+async function setQueue() {
+  const data = {
+    maxActive: parseInt(document.getElementById("maxActive").value) || 0,
+  };
+
+  try {
+    const resp = await fetch("/api/queue", {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify(data),
+      credentials: "include",
+    });
+
+    if (resp.ok) {
+      getDownloadsAndFillTable();
+    } else {
+      console.log(await resp.json());
+    }
+  } catch (err) {
+    console.error("Fetch failed:", err);
+  }
+}
+
+// load global speed limit into input, shown in KB/s
+async function getRateLimit() {
+  try {
+    const resp = await fetch("/api/ratelimit", {
+      method: "GET",
+      credentials: "include",
+    });
+
+    if (resp.ok) {
+      const rateLimit = await resp.json();
+      document.getElementById("globalRateLimit").value = rateLimit.limit / 1000;
+    } else {
+      console.log(await resp.json());
+    }
+  } catch (err) {
+    console.error("Fetch failed:", err);
+  }
+}
+
+// change global speed limit, running downloads are not restarted
+async function setRateLimit() {
+  const data = {
+    limit:
+      (parseInt(document.getElementById("globalRateLimit").value) || 0) * 1000,
+  };
+
+  try {
+    const resp = await fetch("/api/ratelimit", {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify(data),
+      credentials: "include",
+    });
+
+    if (!resp.ok) {
+      console.log(await resp.json());
+    }
+  } catch (err) {
+    console.error("Fetch failed:", err);
+  }
+}
+
+// change schedule of existing download, empty inputs remove it
+async function setSchedule() {
+  const id = parseInt(document.getElementById("scheduleId").value);
+  if (isNaN(id)) {
+    alert("download id is required");
+    return;
+  }
+
+  try {
+    const resp = await fetch(`/api/schedule/${id}`, {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify(getSchedule("scheduleStartAt", "scheduleWindows")),
+      credentials: "include",
+    });
+
+    if (!resp.ok) {
+      alert((await resp.json()).err);
+    }
+  } catch (err) {
+    console.error("Fetch failed:", err);
+  }
+}
+
 // check if cookie token is present / valid
 async function checkSession() {
   try {
@@ -253,11 +595,75 @@ async function checkSession() {
 // run all this after successful login
 function runAfterLogin() {
   getDirInfo();
+  getQueue();
+  getRateLimit();
   getDownloadsAndFillTable();
-  // get data from server every 2 seconds
-  setInterval(() => {
+  listenEvents();
+}
+
+let pollTimer = null;
+let reloadTimer = null;
+let eventSource = null;
+
+// get data from server every 2 seconds, used while events are not available
+function startPolling() {
+  if (!pollTimer) {
+    pollTimer = setInterval(getDownloadsAndFillTable, 2000);
+  }
+}
+
+function stopPolling() {
+  clearInterval(pollTimer);
+  pollTimer = null;
+}
+
+// reload whole table soon, many changes at once cause only single request
+function scheduleReload() {
+  if (!reloadTimer) {
+    reloadTimer = setTimeout(() => {
+      reloadTimer = null;
+      getDownloadsAndFillTable();
+    }, 300);
+  }
+}
+
+// server pushes changes, polling runs while stream is disconnected
+function listenEvents() {
+  if (!window.EventSource) {
+    startPolling();
+    return;
+  }
+  if (eventSource) {
+    eventSource.close();
+  }
+
+  eventSource = new EventSource("/api/events");
+  eventSource.onopen = () => {
+    stopPolling();
+    // events could be missed while disconnected
     getDownloadsAndFillTable();
-  }, "2000");
+  };
+  // browser reconnects on its own, closed stream (e.g. logged out) stays on polling
+  eventSource.onerror = () => startPolling();
+
+  eventSource.addEventListener("added", () => scheduleReload());
+  eventSource.addEventListener("state", (e) => {
+    fillRow(JSON.parse(e.data));
+    // queue positions of other items could change
+    scheduleReload();
+  });
+  eventSource.addEventListener("progress", (e) =>
+    fillProgress(JSON.parse(e.data)),
+  );
+  eventSource.addEventListener("summary", (e) =>
+    fillSummary(JSON.parse(e.data)),
+  );
+  eventSource.addEventListener("deleted", (e) => {
+    const row = document.getElementById(`row${JSON.parse(e.data).id}`);
+    if (row) {
+      row.remove();
+    }
+  });
 }
 
 async function login() {
@@ -20,10 +20,13 @@ var img []byte
 type Server struct {
 	downloadManager *downloader.DownloadManager
 	sessionManger   *SesssionManager
+	metrics         *metrics
+	metricsToken    string
+	apiMux          *http.ServeMux
 	*http.Server
 }
 
-func New(dManager *downloader.DownloadManager, sManager *SesssionManager, address string) *Server {
+func New(dManager *downloader.DownloadManager, sManager *SesssionManager, address string, metricsConfig MetricsConfig) *Server {
 
 	mainMux := http.NewServeMux()
 
@@ -31,6 +34,8 @@ func New(dManager *downloader.DownloadManager, sManager *SesssionManager, addres
 	server := &Server{
 		downloadManager: dManager,
 		sessionManger:   sManager,
+		metrics:         newMetrics(),
+		metricsToken:    metricsConfig.Token,
 	}
 	// serve index.html /{$} just allow /
 	mainMux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
@@ -51,22 +56,44 @@ func New(dManager *downloader.DownloadManager, sManager *SesssionManager, addres
 	// unprotected login route
 	mainMux.HandleFunc("POST /api/login", server.LoginHandler)
 
+	// prometheus metrics, handler checks token itself
+	if metricsConfig.Enabled {
+		mainMux.HandleFunc("GET /metrics", server.MetricsHandler)
+	}
+
 	// create subrouter for all api router
 	apiMux := http.NewServeMux()
+	server.apiMux = apiMux
 	apiMux.HandleFunc("GET /downloads", server.GetAllDownloadsHandler)
+	apiMux.HandleFunc("GET /summary", server.GetSummaryHandler)
+	apiMux.HandleFunc("GET /events", server.EventsHandler)
 	apiMux.HandleFunc("GET /info", server.GetCurDirInfoHandler)
 	apiMux.HandleFunc("POST /add", server.AddAndStartDownloadHandler)
+	apiMux.HandleFunc("POST /add/batch", server.AddBatchHandler)
 	apiMux.HandleFunc("GET /toggle/{id}", server.ToggleHandler)
 	apiMux.HandleFunc("GET /delete/{id}", server.DeleteHandler)
 	apiMux.HandleFunc("GET /logout", server.LogoutHandler)
+	apiMux.HandleFunc("GET /queue", server.GetQueueHandler)
+	apiMux.HandleFunc("POST /queue", server.SetQueueHandler)
+	apiMux.HandleFunc("POST /queue/{id}/{where}", server.MoveHandler)
+	apiMux.HandleFunc("POST /priority/{id}", server.SetPriorityHandler)
+	apiMux.HandleFunc("GET /ratelimit", server.GetRateLimitHandler)
+	apiMux.HandleFunc("POST /ratelimit", server.SetRateLimitHandler)
+	apiMux.HandleFunc("POST /ratelimit/{id}", server.SetItemRateLimitHandler)
+	apiMux.HandleFunc("POST /schedule/{id}", server.SetScheduleHandler)
 
 	// user middleware and assign /api prefix
 	protectedApiMux := server.middlewareAuth(apiMux)
 	mainMux.Handle("/api/", http.StripPrefix("/api", protectedApiMux))
 
+	var handler http.Handler = mainMux
+	if metricsConfig.Enabled {
+		handler = server.middlewareMetrics(handler)
+	}
+
 	server.Server = &http.Server{
 		Addr:    address,
-		Handler: middlewareLog(mainMux), // apply log to all endpoints
+		Handler: middlewareLog(handler), // apply log to all endpoints
 	}
 
 	return server
@@ -48,6 +48,21 @@ func (s *SesssionManager) CreateSession(w http.ResponseWriter) {
 	http.SetCookie(w, cookie)
 }
 
+// number of sessions which did not expire yet
+func (s *SesssionManager) Count() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	count := 0
+	now := time.Now()
+	for _, expTime := range s.sessions {
+		if now.Before(expTime) {
+			count++
+		}
+	}
+	return count
+}
+
 // find if token in map and if it is still valid
 func (s *SesssionManager) IsSessionValid(r *http.Request) bool {
 	cookie, err := r.Cookie("medownloader_token")